@@ -0,0 +1,1035 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+)
+
+// admin is the authenticated administration surface: a JSON API under
+// /admin/api/ and a dashboard at /admin/.
+type admin struct {
+	token string
+	pool  *redis.Pool
+}
+
+// newAdminHandler returns the admin surface, or nil if token is empty, in
+// which case it is disabled.
+func newAdminHandler(token string, pool *redis.Pool) http.Handler {
+	if token == "" {
+		return nil
+	}
+	a := &admin{token: token, pool: pool}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/", globalOnly(a.handleDashboard))
+	mux.HandleFunc("/admin/events", globalOnly(a.handleEvents))
+	mux.HandleFunc("/admin/api/status", globalOnly(a.handleStatus))
+	mux.HandleFunc("/debug/status", globalOnly(a.handleStatus))
+	mux.HandleFunc("/admin/api/connections", a.handleConnections)
+	mux.HandleFunc("/admin/api/connections/", a.handleConnection)
+	mux.HandleFunc("/admin/api/announcements", a.handleAnnouncement)
+	mux.HandleFunc("/admin/api/bans", a.handleBans)
+	mux.HandleFunc("/admin/api/bans/", a.handleBan)
+	mux.HandleFunc("/admin/api/sites", a.handleSites)
+	mux.HandleFunc("/admin/api/sites/", a.handleSite)
+	mux.HandleFunc("/admin/api/room", a.handleRoom)
+	mux.HandleFunc("/admin/api/invites", a.handleInvites)
+	mux.HandleFunc("/admin/api/invites/", a.handleInvite)
+	mux.HandleFunc("/admin/api/emoji", a.handleEmojiList)
+	mux.HandleFunc("/admin/api/emoji/", a.handleEmoji)
+	mux.HandleFunc("/admin/api/qa", a.handleQuestions)
+	mux.HandleFunc("/admin/api/qa/export", a.handleQuestionExport)
+	mux.HandleFunc("/admin/api/qa/", a.handleQuestion)
+	mux.HandleFunc("/admin/api/log-level", globalOnly(a.handleLogLevel))
+	mux.HandleFunc("/admin/api/config", globalOnly(a.handleConfig))
+	mux.HandleFunc("/admin/api/tenants", globalOnly(a.handleTenants))
+	mux.HandleFunc("/admin/api/tenants/", globalOnly(a.handleTenant))
+	return a.authenticate(rejectCrossSite(mux))
+}
+
+// rejectCrossSite protects the dashboard, which authenticates with basic auth
+// that browsers send on their own, from cross-site requests: requests that
+// change state must come from the same origin, if the browser says where
+// they come from, and requests with a body must have a JSON, or for emoji an
+// image, content type, which a cross-site form can't send without a CORS
+// preflight the admin surface never answers.
+func rejectCrossSite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+				http.Error(w, "Cross-origin request", http.StatusForbidden)
+				return
+			}
+		}
+		if r.Method != "DELETE" {
+			mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			allowed := mt == "application/json"
+			if strings.HasPrefix(r.URL.Path, "/admin/api/emoji/") {
+				allowed = allowed || mt == "image/png" || mt == "image/jpeg" || mt == "image/gif"
+			}
+			if !allowed {
+				http.Error(w, "Unsupported Content-Type", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type scopeKey struct{}
+
+// authenticate requires the admin token, or a tenant's admin token, either as
+// a bearer token, for API clients, or as the basic auth password, so that the
+// dashboard works in a browser. The tenant is recorded in the request's
+// context for scopeOf.
+func (a *admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, pass, ok := r.BasicAuth(); ok {
+			token = pass
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if t := tenants.byToken(token, true); t != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeKey{}, t.ID)))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="chat admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// scopeOf returns the tenant whose admin made the request, or nil if it was
+// made with the admin token, which isn't limited to a tenant.
+func scopeOf(r *http.Request) (t *tenant, scoped bool) {
+	id, scoped := r.Context().Value(scopeKey{}).(string)
+	if !scoped {
+		return nil, false
+	}
+	return tenants.get(id), true
+}
+
+// globalOnly restricts h to requests made with the admin token.
+func globalOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, scoped := scopeOf(r); scoped {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// tenants returns the tenants a request applies to: the tenant of a tenant's
+// admin, the tenant named by the tenant query parameter, or every tenant. It
+// writes an error and returns nil if there is no such tenant.
+func (a *admin) tenants(w http.ResponseWriter, r *http.Request) []*tenant {
+	t, scoped := scopeOf(r)
+	if !scoped {
+		id, ok := r.URL.Query()["tenant"]
+		if !ok {
+			return tenants.all()
+		}
+		t = tenants.get(id[0])
+	}
+	if t == nil {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return nil
+	}
+	return []*tenant{t}
+}
+
+// tenant returns the single tenant a request applies to, which is the default
+// tenant for requests made with the admin token that don't name one. It
+// writes an error and returns nil if there is no such tenant.
+func (a *admin) tenant(w http.ResponseWriter, r *http.Request) *tenant {
+	ts := a.tenants(w, r)
+	if len(ts) > 1 {
+		return defaultTenant
+	}
+	if len(ts) == 0 {
+		return nil
+	}
+	return ts[0]
+}
+
+// connections lists the connections of ts in the cluster. This instance's
+// connections come from the hub directly as the registry may be stale.
+func (a *admin) connections(ts []*tenant) ([]clientInfo, error) {
+	wanted := make(map[string]bool, len(ts))
+	var clients []clientInfo
+	for _, t := range ts {
+		wanted[t.ID] = true
+		cluster, err := clusterClients(a.pool, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cluster {
+			if c.Instance != instance {
+				clients = append(clients, c)
+			}
+		}
+	}
+	local := make([]clientInfo, 0, len(clients))
+	for _, c := range rr.clients() {
+		if wanted[c.Tenant] {
+			local = append(local, c)
+		}
+	}
+	return append(local, clients...), nil
+}
+
+func (a *admin) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeStatus(w)
+}
+
+func (a *admin) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts := a.tenants(w, r)
+	if ts == nil {
+		return
+	}
+	clients, err := a.connections(ts)
+	if err != nil {
+		log.WithField("err", err).Error("Unable to list connections")
+		http.Error(w, "Unable to list connections", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
+
+// handleConnection disconnects the connection named in the URL, or approves
+// it with POST .../approve or upgrades a guest with POST .../upgrade, on
+// whichever instance it lives.
+func (a *admin) handleConnection(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/api/connections/")
+	op, method := opDisconnect, "DELETE"
+	if i := strings.Index(id, "/"); i >= 0 {
+		switch id[i+1:] {
+		case "approve":
+			op = opApprove
+		case "upgrade":
+			op = opUpgrade
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		id, method = id[:i], "POST"
+	}
+	if r.Method != method {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if id == "" {
+		http.Error(w, "Missing connection id", http.StatusBadRequest)
+		return
+	}
+	ts := a.tenants(w, r)
+	if ts == nil {
+		return
+	}
+	clients, err := a.connections(ts)
+	if err != nil {
+		log.WithField("err", err).Error("Unable to list connections")
+		http.Error(w, "Unable to list connections", http.StatusBadGateway)
+		return
+	}
+	tenant := ""
+	found := false
+	for _, c := range clients {
+		if c.ID == id {
+			tenant, found = c.Tenant, true
+		}
+	}
+	if !found {
+		http.Error(w, "Unknown connection", http.StatusNotFound)
+		return
+	}
+	if err := publishControl(a.pool, controlCommand{Op: op, ID: id, Tenant: tenant}); err != nil {
+		log.WithFields(logrus.Fields{"op": op, "err": err}).Error("Unable to act on connection")
+		http.Error(w, "Unable to reach connection", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleAnnouncement broadcasts a system message to every connection of the
+// tenants the request applies to.
+func (a *admin) handleAnnouncement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts := a.tenants(w, r)
+	if ts == nil {
+		return
+	}
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Text == "" {
+		http.Error(w, "Body must be a JSON object with a text", http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(message{Handle: "system", Text: req.Text})
+	if err != nil {
+		http.Error(w, "Unable to encode announcement", http.StatusInternalServerError)
+		return
+	}
+	for _, t := range ts {
+		log.WithFields(logrus.Fields{"text": req.Text, "tenant": t.name()}).Info("Broadcasting announcement")
+		rw.publish(t, data)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleBans lists or adds bans of a tenant.
+func (a *admin) handleBans(w http.ResponseWriter, r *http.Request) {
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		entries, err := listBans(a.pool, t)
+		if err != nil {
+			log.WithField("err", err).Error("Unable to list bans")
+			http.Error(w, "Unable to list bans", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case "POST":
+		var req struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Value == "" {
+			http.Error(w, "Body must be a JSON object with a value", http.StatusBadRequest)
+			return
+		}
+		if err := addBan(a.pool, t, req.Value); err != nil {
+			log.WithField("err", err).Error("Unable to add ban")
+			http.Error(w, "Unable to add ban", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBan lifts the ban named in the URL.
+func (a *admin) handleBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	value := strings.TrimPrefix(r.URL.Path, "/admin/api/bans/")
+	if value == "" {
+		http.Error(w, "Missing ban", http.StatusBadRequest)
+		return
+	}
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	if err := removeBan(a.pool, t, value); err != nil {
+		log.WithField("err", err).Error("Unable to remove ban")
+		http.Error(w, "Unable to remove ban", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSites lists the sites embedding the widget, or creates or updates
+// one. Sites belong to the tenant of the request.
+func (a *admin) handleSites(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		ts := a.tenants(w, r)
+		if ts == nil {
+			return
+		}
+		list, err := listSites(a.pool, ts)
+		if err != nil {
+			log.WithField("err", err).Error("Unable to list sites")
+			http.Error(w, "Unable to list sites", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		t := a.tenant(w, r)
+		if t == nil {
+			return
+		}
+		var s site
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Body must be a JSON site", http.StatusBadRequest)
+			return
+		}
+		s.Tenant = t.ID
+		if s.Key != "" {
+			existing, err := getSite(a.pool, s.Key)
+			if err != nil {
+				log.WithField("err", err).Error("Unable to read site")
+				http.Error(w, "Unable to read site", http.StatusBadGateway)
+				return
+			}
+			if existing == nil || existing.Tenant != t.ID {
+				http.Error(w, "Unknown site", http.StatusNotFound)
+				return
+			}
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveSite(a.pool, &s); err != nil {
+			log.WithField("err", err).Error("Unable to save site")
+			http.Error(w, "Unable to save site", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSite removes the site named in the URL.
+func (a *admin) handleSite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/admin/api/sites/")
+	s, err := getSite(a.pool, key)
+	if err != nil {
+		log.WithField("err", err).Error("Unable to read site")
+		http.Error(w, "Unable to read site", http.StatusBadGateway)
+		return
+	}
+	if s == nil || s.Tenant != t.ID {
+		http.Error(w, "Unknown site", http.StatusNotFound)
+		return
+	}
+	if err := removeSite(a.pool, key); err != nil {
+		log.WithField("err", err).Error("Unable to remove site")
+		http.Error(w, "Unable to remove site", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRoom returns or replaces the settings of a tenant's room.
+func (a *admin) handleRoom(w http.ResponseWriter, r *http.Request) {
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		s, err := loadRoom(a.pool, t)
+		if err != nil {
+			log.WithField("err", err).Error("Unable to read room settings")
+			http.Error(w, "Unable to read room settings", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case "PUT":
+		var s roomSettings
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Body must be JSON room settings", http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveRoom(a.pool, t, s); err != nil {
+			log.WithField("err", err).Error("Unable to save room settings")
+			http.Error(w, "Unable to save room settings", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleInvites lists the invites to a tenant's room, or creates one.
+func (a *admin) handleInvites(w http.ResponseWriter, r *http.Request) {
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		list, err := listInvites(a.pool, t)
+		if err != nil {
+			log.WithField("err", err).Error("Unable to list invites")
+			http.Error(w, "Unable to list invites", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		if cfg().InviteSecret == "" {
+			http.Error(w, "Invites are disabled, invite_secret is not set", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			MaxUses    int `json:"max_uses"`
+			TTLSeconds int `json:"ttl_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MaxUses < 1 || req.TTLSeconds < 1 {
+			http.Error(w, "Body must be a JSON object with a positive max_uses and ttl_seconds", http.StatusBadRequest)
+			return
+		}
+		inv, err := createInvite(a.pool, t, req.MaxUses, time.Duration(req.TTLSeconds)*time.Second)
+		if err != nil {
+			log.WithField("err", err).Error("Unable to create invite")
+			http.Error(w, "Unable to create invite", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusCreated, inv)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleInvite revokes the invite named in the URL.
+func (a *admin) handleInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	found, err := revokeInvite(a.pool, t, strings.TrimPrefix(r.URL.Path, "/admin/api/invites/"))
+	if err != nil {
+		log.WithField("err", err).Error("Unable to revoke invite")
+		http.Error(w, "Unable to revoke invite", http.StatusBadGateway)
+		return
+	}
+	if !found {
+		http.Error(w, "Unknown invite", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEmojiList lists the custom emoji of a tenant.
+func (a *admin) handleEmojiList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	list, err := listEmoji(a.pool, t)
+	if err != nil {
+		log.WithField("err", err).Error("Unable to list emoji")
+		http.Error(w, "Unable to list emoji", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleEmoji uploads the custom emoji named in the URL, with the image as
+// the request body, or removes it.
+func (a *admin) handleEmoji(w http.ResponseWriter, r *http.Request) {
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/api/emoji/")
+	switch r.Method {
+	case "PUT":
+		upload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEmojiUploadBytes+1))
+		if err != nil {
+			http.Error(w, "Unable to read image", http.StatusBadRequest)
+			return
+		}
+		e, err := saveEmoji(a.pool, t, name, upload)
+		if err != nil {
+			log.WithField("err", err).Warning("Unable to save emoji")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+	case "DELETE":
+		if _, ok := customEmojis.get(t)[name]; !ok {
+			http.Error(w, "Unknown emoji", http.StatusNotFound)
+			return
+		}
+		if err := removeEmoji(a.pool, t, name); err != nil {
+			log.WithField("err", err).Error("Unable to remove emoji")
+			http.Error(w, "Unable to remove emoji", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleQuestions lists the questions asked in a tenant's room, or clears
+// them.
+func (a *admin) handleQuestions(w http.ResponseWriter, r *http.Request) {
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		list, err := listQuestions(a.pool, t)
+		if err != nil {
+			log.WithField("err", err).Error("Unable to list questions")
+			http.Error(w, "Unable to list questions", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case "DELETE":
+		if err := clearQuestions(a.pool, t); err != nil {
+			log.WithField("err", err).Error("Unable to clear questions")
+			http.Error(w, "Unable to clear questions", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleQuestion marks the question named in the URL answered or dismissed,
+// or reopens it.
+func (a *admin) handleQuestion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Body must be a JSON object with a status", http.StatusBadRequest)
+		return
+	}
+	if req.Status != questionOpen && req.Status != questionAnswered && req.Status != questionDismissed {
+		http.Error(w, "Status must be open, answered or dismissed", http.StatusBadRequest)
+		return
+	}
+	q, err := setQuestionStatus(a.pool, t, strings.TrimPrefix(r.URL.Path, "/admin/api/qa/"), req.Status)
+	if err != nil {
+		log.WithField("err", err).Error("Unable to update question")
+		http.Error(w, "Unable to update question", http.StatusBadGateway)
+		return
+	}
+	if q == nil {
+		http.Error(w, "Unknown question", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
+
+// handleQuestionExport downloads the questions of a tenant's room as JSON,
+// or as CSV with format=csv, for the record after the event.
+func (a *admin) handleQuestionExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := a.tenant(w, r)
+	if t == nil {
+		return
+	}
+	list, err := listQuestions(a.pool, t)
+	if err != nil {
+		log.WithField("err", err).Error("Unable to list questions")
+		http.Error(w, "Unable to list questions", http.StatusBadGateway)
+		return
+	}
+	if r.URL.Query().Get("format") != "csv" {
+		w.Header().Set("Content-Disposition", `attachment; filename="questions.json"`)
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="questions.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "status", "votes", "handle", "text", "asked_at", "closed_at"})
+	for _, q := range list {
+		closed := ""
+		if q.ClosedAt != nil {
+			closed = q.ClosedAt.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{q.ID, q.Status, fmt.Sprint(q.Votes), q.Handle, q.Text, q.AskedAt.UTC().Format(time.RFC3339), closed})
+	}
+	cw.Flush()
+}
+
+// handleTenants lists the tenants, or creates or updates one.
+func (a *admin) handleTenants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		list, err := listTenants(a.pool)
+		if err != nil {
+			log.WithField("err", err).Error("Unable to list tenants")
+			http.Error(w, "Unable to list tenants", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		var t tenant
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Body must be a JSON tenant", http.StatusBadRequest)
+			return
+		}
+		if err := t.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveTenant(a.pool, &t); err != nil {
+			log.WithField("err", err).Error("Unable to save tenant")
+			http.Error(w, "Unable to save tenant", http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTenant removes the tenant named in the URL along with its data.
+func (a *admin) handleTenant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/admin/api/tenants/")
+	if id == "" || tenants.get(id) == nil {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return
+	}
+	if err := removeTenant(a.pool, id); err != nil {
+		log.WithField("err", err).Error("Unable to remove tenant")
+		http.Error(w, "Unable to remove tenant", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLogLevel changes the log level of every instance.
+func (a *admin) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]string{"level": logrus.GetLevel().String()})
+	case "PUT":
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Body must be a JSON object with a level", http.StatusBadRequest)
+			return
+		}
+		a.changeConfig(w, map[string]string{"log_level": req.Level})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleConfig returns the effective configuration, with secrets redacted,
+// or changes reloadable settings on every instance.
+func (a *admin) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		settings := make(map[string]string)
+		for _, f := range cfg().fields() {
+			settings[f.key] = f.redacted()
+		}
+		writeJSON(w, http.StatusOK, settings)
+	case "PATCH":
+		var settings map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Body must be a JSON object of settings", http.StatusBadRequest)
+			return
+		}
+		a.changeConfig(w, settings)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// changeConfig publishes settings to every instance and responds with the
+// resulting changes.
+func (a *admin) changeConfig(w http.ResponseWriter, settings map[string]string) {
+	_, changes, err := cfg().with(settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if changes == nil {
+		changes = []configChange{}
+	} else if err := publishControl(a.pool, controlCommand{Op: opConfig, Settings: settings}); err != nil {
+		log.WithField("err", err).Error("Unable to change configuration")
+		http.Error(w, "Unable to change configuration", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string][]configChange{"changes": changes})
+}
+
+// dashboardCounts is sent to the dashboard on every event.
+type dashboardCounts struct {
+	Instance            string  `json:"instance"`
+	LocalConnections    int     `json:"local_connections"`
+	ClusterConnections  int     `json:"cluster_connections"`
+	MessagesReceived    float64 `json:"messages_received"`
+	MessagesSent        float64 `json:"messages_sent"`
+	OutboxDepth         int     `json:"outbox_depth"`
+	BroadcastQueueDepth int     `json:"broadcast_queue_depth"`
+}
+
+func (a *admin) counts() dashboardCounts {
+	c := dashboardCounts{
+		Instance:            instance,
+		LocalConnections:    len(rr.clients()),
+		MessagesReceived:    messagesIn.value(instance),
+		MessagesSent:        messagesOut.value(instance),
+		OutboxDepth:         len(rw.messages),
+		BroadcastQueueDepth: len(rr.messages),
+	}
+	c.ClusterConnections = c.LocalConnections
+	if clients, err := a.connections(tenants.all()); err == nil {
+		c.ClusterConnections = len(clients)
+	}
+	return c
+}
+
+// handleEvents streams dashboardCounts as server-sent events.
+func (a *admin) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(cfg().AdminEventInterval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(a.counts())
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: counts\ndata: %s\n\n", data)
+		flusher.Flush()
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (a *admin) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+	clients, err := a.connections(tenants.all())
+	if err != nil {
+		log.WithField("err", err).Error("Unable to list connections")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = dashboardTemplate.Execute(w, struct {
+		Counts      dashboardCounts
+		Readiness   readiness
+		Connections []clientInfo
+		Tenants     []*tenant
+		LogLevel    string
+		LogLevels   []string
+	}{
+		Counts:      a.counts(),
+		Readiness:   checkReadiness(),
+		Connections: clients,
+		Tenants:     tenants.all(),
+		LogLevel:    logrus.GetLevel().String(),
+		LogLevels:   logLevels(),
+	})
+	if err != nil {
+		log.WithField("err", err).Error("Error rendering dashboard")
+	}
+}
+
+func logLevels() []string {
+	levels := make([]string, 0, len(logrus.AllLevels))
+	for _, l := range logrus.AllLevels {
+		levels = append(levels, l.String())
+	}
+	return levels
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chat admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.counts span { display: inline-block; margin-right: 2em; }
+</style>
+</head>
+<body>
+<h1>Chat admin <small>{{.Counts.Instance}}</small></h1>
+
+<p class="counts">
+<span>Connections here: <b id="local_connections">{{.Counts.LocalConnections}}</b></span>
+<span>Connections in cluster: <b id="cluster_connections">{{.Counts.ClusterConnections}}</b></span>
+<span>Received: <b id="messages_received">{{.Counts.MessagesReceived}}</b></span>
+<span>Sent: <b id="messages_sent">{{.Counts.MessagesSent}}</b></span>
+<span>Outbox: <b id="outbox_depth">{{.Counts.OutboxDepth}}</b></span>
+<span>Broadcast queue: <b id="broadcast_queue_depth">{{.Counts.BroadcastQueueDepth}}</b></span>
+</p>
+
+<p>Ready: <b>{{.Readiness.Ready}}</b>{{range .Readiness.Reasons}} ({{.}}){{end}}.
+Redis receiver connected: {{.Readiness.Receiver.Connected}}, writer connected: {{.Readiness.Writer.Connected}}.</p>
+
+<h2>Announcement</h2>
+<form id="announce"><input name="text" size="60"> <button>Broadcast</button></form>
+
+<h2>Room settings</h2>
+<form id="room">
+<p><select name="tenant">
+{{range .Tenants}}<option value="{{.ID}}">{{if .ID}}{{.ID}}{{else}}default{{end}}</option>{{end}}
+</select></p>
+<p><label>Mode <select name="mode"><option value="">chat</option><option value="qa">qa</option></select></label>
+<label>Slow mode seconds <input name="slow_mode_seconds" type="number" min="0" size="5"></label>
+<label>Max members <input name="max_members" type="number" min="0" size="5"></label></p>
+<p><label><input name="read_only" type="checkbox"> Read only</label>
+<label><input name="no_guests" type="checkbox"> No guests</label>
+<label><input name="require_approval" type="checkbox"> Require approval</label>
+<label><input name="transcript" type="checkbox"> Transcript</label></p>
+<p><button>Save</button> <span id="room_status"></span></p>
+</form>
+
+<h2>Log level</h2>
+<form id="loglevel">
+<select name="level">
+{{range $l := .LogLevels}}<option{{if eq $l $.LogLevel}} selected{{end}}>{{$l}}</option>{{end}}
+</select> <button>Apply</button>
+</form>
+
+<h2>Connections</h2>
+<table>
+<tr><th>ID</th><th>Instance</th><th>Handle</th><th>Remote address</th><th>Connected</th><th>Last seen</th><th>Received</th><th></th></tr>
+{{range .Connections}}
+<tr>
+<td>{{.ID}}</td><td>{{.Instance}}</td><td>{{.Handle}}</td><td>{{.RemoteAddr}}</td>
+<td>{{.ConnectedAt.Format "2006-01-02 15:04:05"}}</td><td>{{.LastSeen.Format "2006-01-02 15:04:05"}}</td><td>{{.Received}}</td>
+<td><button data-disconnect="{{.ID}}">Disconnect</button></td>
+</tr>
+{{else}}
+<tr><td colspan="8">No connections</td></tr>
+{{end}}
+</table>
+
+<script>
+new EventSource("/admin/events").addEventListener("counts", function (e) {
+  var counts = JSON.parse(e.data);
+  Object.keys(counts).forEach(function (k) {
+    var el = document.getElementById(k);
+    if (el) { el.textContent = counts[k]; }
+  });
+});
+function send(method, url, body) {
+  return fetch(url, {method: method, credentials: "same-origin",
+    headers: {"Content-Type": "application/json"}, body: body && JSON.stringify(body)});
+}
+document.getElementById("announce").addEventListener("submit", function (e) {
+  e.preventDefault();
+  send("POST", "/admin/api/announcements", {text: e.target.text.value}).then(function () { e.target.reset(); });
+});
+var room = document.getElementById("room");
+function roomURL() {
+  return "/admin/api/room?tenant=" + encodeURIComponent(room.tenant.value);
+}
+function loadRoom() {
+  fetch(roomURL(), {credentials: "same-origin"}).then(function (r) { return r.json(); }).then(function (s) {
+    room.mode.value = s.mode || "";
+    room.slow_mode_seconds.value = s.slow_mode_seconds || 0;
+    room.max_members.value = s.max_members || 0;
+    ["read_only", "no_guests", "require_approval", "transcript"].forEach(function (k) { room[k].checked = !!s[k]; });
+    document.getElementById("room_status").textContent = "";
+  });
+}
+room.tenant.addEventListener("change", loadRoom);
+room.addEventListener("submit", function (e) {
+  e.preventDefault();
+  send("PUT", roomURL(), {
+    mode: room.mode.value,
+    slow_mode_seconds: parseInt(room.slow_mode_seconds.value, 10) || 0,
+    max_members: parseInt(room.max_members.value, 10) || 0,
+    read_only: room.read_only.checked,
+    no_guests: room.no_guests.checked,
+    require_approval: room.require_approval.checked,
+    transcript: room.transcript.checked
+  }).then(function (r) {
+    return r.text().then(function (text) {
+      document.getElementById("room_status").textContent = r.ok ? "Saved" : text;
+    });
+  });
+});
+loadRoom();
+document.getElementById("loglevel").addEventListener("submit", function (e) {
+  e.preventDefault();
+  send("PUT", "/admin/api/log-level", {level: e.target.level.value});
+});
+document.querySelectorAll("[data-disconnect]").forEach(function (b) {
+  b.addEventListener("click", function () {
+    send("DELETE", "/admin/api/connections/" + b.dataset.disconnect).then(function () { location.reload(); });
+  });
+});
+</script>
+</body>
+</html>
+`))
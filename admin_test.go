@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRejectCrossSite(t *testing.T) {
+	h := rejectCrossSite(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		method, path, origin, contentType string
+		want                              int
+	}{
+		{"GET", "/admin/api/bans", "https://evil.example.com", "", http.StatusOK},
+		{"POST", "/admin/api/bans", "", "application/json", http.StatusOK},
+		{"POST", "/admin/api/bans", "http://admin.example.com", "application/json; charset=utf-8", http.StatusOK},
+		{"POST", "/admin/api/bans", "https://evil.example.com", "application/json", http.StatusForbidden},
+		{"POST", "/admin/api/bans", "null", "application/json", http.StatusForbidden},
+		{"POST", "/admin/api/bans", "", "text/plain", http.StatusUnsupportedMediaType},
+		{"POST", "/admin/api/announcements", "", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"POST", "/admin/api/connections/abc/approve", "", "", http.StatusUnsupportedMediaType},
+		{"PUT", "/admin/api/emoji/logo", "", "image/png", http.StatusOK},
+		{"PUT", "/admin/api/room", "", "image/png", http.StatusUnsupportedMediaType},
+		{"DELETE", "/admin/api/bans/mallory", "", "", http.StatusOK},
+		{"DELETE", "/admin/api/bans/mallory", "https://evil.example.com", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://admin.example.com"+tt.path, nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s %s (origin %q, %q) = %d, want %d", tt.method, tt.path, tt.origin, tt.contentType, w.Code, tt.want)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	_, pool := testHub(t)
+	useTenants(t, &tenant{ID: "acme"})
+	a := &admin{token: "secret", pool: pool}
+	w := httptest.NewRecorder()
+	a.handleDashboard(w, httptest.NewRequest("GET", "/admin/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("dashboard = %d", w.Code)
+	}
+	for _, want := range []string{`<form id="room">`, `<option value="">default</option>`, `<option value="acme">acme</option>`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("dashboard lacks %s", want)
+		}
+	}
+}
+
+func TestStatusRequiresAdminToken(t *testing.T) {
+	_, pool := testHub(t)
+	useTenants(t, &tenant{ID: "acme", AdminToken: "acme-admin"})
+	h := newAdminHandler("secret", pool)
+	tests := []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"acme-admin", http.StatusForbidden},
+		{"secret", http.StatusOK},
+	}
+	for _, path := range []string{"/debug/status", "/admin/api/status"} {
+		for _, tt := range tests {
+			r := httptest.NewRequest("GET", path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s with token %q = %d, want %d", path, tt.token, w.Code, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"sort"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// banList is this instance's copy of the bans stored in Redis, by tenant. Each
+// tenant's bans are held in the set at its "bans" key.
+type banList struct {
+	*tenantCache
+}
+
+var bans = banList{newTenantCache(banSet)}
+
+func banSet(pool *redis.Pool, t *tenant) (interface{}, error) {
+	entries, err := listBans(pool, t)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		m[e] = true
+	}
+	return m, nil
+}
+
+// banned returns true if handle or addr is banned by t. Bans are on bare
+// addresses, so the port of addr, if any, is ignored. Either may be empty.
+func (b banList) banned(t *tenant, handle, addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	m, _ := b.value(t).(map[string]bool)
+	return (handle != "" && m[handle]) || (addr != "" && m[addr])
+}
+
+// kickBanned disconnects the connections of t on this instance whose handle
+// or address is banned.
+func (b banList) kickBanned(t *tenant) {
+	for _, c := range rr.clients() {
+		if c.Tenant == t.ID && b.banned(t, c.Handle, c.RemoteAddr) {
+			rr.kick(t.ID, c.ID)
+		}
+	}
+}
+
+func listBans(pool *redis.Pool, t *tenant) ([]string, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	entries, err := redis.Strings(conn.Do("SMEMBERS", t.key("bans")))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list bans")
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// addBan bans a handle or remote address from t across the cluster.
+func addBan(pool *redis.Pool, t *tenant, value string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SADD", t.key("bans"), value); err != nil {
+		return errors.Wrap(err, "Unable to add ban")
+	}
+	return publishControl(pool, controlCommand{Op: opBansChanged, Tenant: t.ID})
+}
+
+// removeBan lifts a ban from t across the cluster.
+func removeBan(pool *redis.Pool, t *tenant, value string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SREM", t.key("bans"), value); err != nil {
+		return errors.Wrap(err, "Unable to remove ban")
+	}
+	return publishControl(pool, controlCommand{Op: opBansChanged, Tenant: t.ID})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBanAddressWithoutProxy(t *testing.T) {
+	fake, pool := testHub(t)
+	useTenants(t)
+	if err := addBan(pool, defaultTenant, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bans.loadAll(pool); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fake.flush()
+		bans.loadAll(pool)
+	})
+
+	if !bans.banned(defaultTenant, "", "127.0.0.1:5000") {
+		t.Error("ban on 127.0.0.1 doesn't match 127.0.0.1:5000")
+	}
+	if !bans.banned(defaultTenant, "", "127.0.0.1") {
+		t.Error("ban on 127.0.0.1 doesn't match 127.0.0.1")
+	}
+
+	// The test server is reached directly, without X-Forwarded-For.
+	server := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	defer server.Close()
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err == nil {
+		ws.Close()
+		t.Fatal("banned address connected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("dial = %v, %v; want 403", resp, err)
+	}
+}
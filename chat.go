@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
@@ -11,20 +14,76 @@ import (
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+	// upgrader's buffer sizes are set from the configuration by serve.
+	upgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+)
+
+// checkOrigin allows same origin requests, like the upgrader's default, and
+// requests from the widget, whose origin is checked against its site by
+// handleWebsocket.
+func checkOrigin(r *http.Request) bool {
+	if r.URL.Query().Get("widget_token") != "" {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
 	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Message types sent by clients. Messages without a type are chat messages.
+const (
+	messageQuestion = "question"
+	messageUpvote   = "upvote"
+	messageSnippet  = "snippet"
+)
+
+// Frame types only sent by the server.
+const (
+	frameQARanking = "qa_ranking"
 )
 
 // message sent to us by the javascript client
 type message struct {
+	Type   string `json:"type,omitempty"`
 	Handle string `json:"handle"`
 	Text   string `json:"text"`
+
+	// ID is the question an upvote is for, or the client's ID of a chat
+	// message.
+	ID string `json:"id,omitempty"`
+
+	// Timestamp is when the client sent a chat message, in milliseconds.
+	Timestamp int64 `json:"timestamp,omitempty"`
+
+	// Language is the language of a snippet, detected when empty.
+	Language string `json:"lang,omitempty"`
+}
+
+// chatMessage is a chat message as published. It is built from the
+// validated message rather than forwarding what the client sent, so that
+// other clients only ever get the fields listed here.
+type chatMessage struct {
+	Handle    string `json:"handle"`
+	Text      string `json:"text"`
+	ID        string `json:"id,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+
+	// Emoji are the custom emoji used in Text, by name.
+	Emoji map[string]string `json:"emoji,omitempty"`
+}
+
+// newChatMessage builds the chat message published for msg, with the
+// shortcodes in its text expanded for t.
+func newChatMessage(t *tenant, msg message) chatMessage {
+	text, used := expandShortcodes(t, msg.Text)
+	return chatMessage{Handle: msg.Handle, Text: text, ID: msg.ID, Timestamp: msg.Timestamp, Emoji: used}
 }
 
 // validateMessage so that we know it's valid JSON and contains a Handle and
-// Text
+// Text, or the fields required by its type.
 func validateMessage(data []byte) (message, error) {
 	var msg message
 
@@ -32,13 +91,48 @@ func validateMessage(data []byte) (message, error) {
 		return msg, errors.Wrap(err, "Unmarshaling message")
 	}
 
-	if msg.Handle == "" && msg.Text == "" {
-		return msg, errors.New("Message has no Handle or Text")
+	switch msg.Type {
+	case "", messageQuestion:
+		if msg.Handle == "" && msg.Text == "" {
+			return msg, errors.New("Message has no Handle or Text")
+		}
+		if len(msg.Text) > cfg().MaxTextBytes {
+			return msg, errors.Errorf("Text is longer than %d bytes", cfg().MaxTextBytes)
+		}
+	case messageSnippet:
+		if strings.TrimSpace(msg.Text) == "" {
+			return msg, errors.New("Snippet is empty")
+		}
+		if len(msg.Text) > cfg().MaxSnippetBytes {
+			return msg, errors.Errorf("Snippet is longer than %d bytes", cfg().MaxSnippetBytes)
+		}
+	case messageUpvote:
+		if msg.ID == "" {
+			return msg, errors.New("Upvote has no question ID")
+		}
+	default:
+		return msg, errors.Errorf("Unknown message type %q", msg.Type)
 	}
 
 	return msg, nil
 }
 
+// validateFrame checks data received from Redis, which is either a message
+// or a frame sent by the server.
+func validateFrame(data []byte) error {
+	var frame struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return errors.Wrap(err, "Unmarshaling frame")
+	}
+	if frame.Type == frameQARanking || frame.Type == messageSnippet {
+		return nil
+	}
+	_, err := validateMessage(data)
+	return err
+}
+
 // handleWebsocket connection.
 func handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -46,6 +140,78 @@ func handleWebsocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if draining.active() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	t, ok := tenants.resolve(r)
+	var guest guestClaims
+	if token := r.URL.Query().Get("widget_token"); token != "" {
+		var err error
+		if t, guest, err = widgetGuest(rr.pool, r, token); err != nil {
+			log.WithField("err", err).Warning("Rejected widget connection")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	} else if token := r.URL.Query().Get("invite"); token != "" {
+		// The invite is used below, once the other checks have passed.
+		var err error
+		if t, _, err = openInvite(rr.pool, token); err != nil {
+			log.WithField("err", err).Warning("Rejected connection with an invite")
+			http.Error(w, "Invalid invite", http.StatusForbidden)
+			return
+		}
+	} else if !ok {
+		http.Error(w, "Unknown tenant", http.StatusForbidden)
+		return
+	}
+
+	if bans.banned(t, "", remoteAddr(r)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if ok, err := t.allowConnection(rr.pool); err != nil {
+		log.WithFields(logrus.Fields{"tenant": t.name(), "err": err}).Error("Unable to check connection quota")
+	} else if !ok {
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	room := rooms.get(t)
+	if guest.Handle != "" {
+		if room.NoGuests {
+			http.Error(w, "Guests are not allowed", http.StatusForbidden)
+			return
+		}
+		if ok, err := t.allowGuest(rr.pool); err != nil {
+			log.WithFields(logrus.Fields{"tenant": t.name(), "err": err}).Error("Unable to check guest quota")
+		} else if !ok {
+			http.Error(w, "Too many guests", http.StatusTooManyRequests)
+			return
+		}
+	}
+	if full, err := room.full(rr.pool, t); err != nil {
+		log.WithFields(logrus.Fields{"tenant": t.name(), "err": err}).Error("Unable to check room member cap")
+	} else if full {
+		http.Error(w, "Room is full", http.StatusTooManyRequests)
+		return
+	}
+	var invite string
+	if token := r.URL.Query().Get("invite"); token != "" && guest.Handle == "" {
+		var err error
+		if _, invite, err = joinInvite(rr.pool, token, remoteAddr(r)); err != nil {
+			log.WithField("err", err).Warning("Rejected connection with an invite")
+			http.Error(w, "Invalid invite", http.StatusForbidden)
+			return
+		}
+	}
+	if room.Private && invite == "" {
+		http.Error(w, "Private room", http.StatusForbidden)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		m := "Unable to upgrade to websockets"
@@ -54,32 +220,167 @@ func handleWebsocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rr.register(ws)
+	// Allow for JSON escaping doubling the size of the largest snippet.
+	ws.SetReadLimit(2 * int64(cfg().MaxSnippetBytes))
+
+	c := newClient(ws, r, t, guest.Handle, room.RequireApproval)
+	c.invite = invite
+	go c.writeLoop()
+	rr.register(c)
+
+	if guest.Handle != "" {
+		// Guest sessions end with their token, unless upgraded meanwhile.
+		expiry := time.AfterFunc(time.Until(time.Unix(guest.Expires, 0)), func() {
+			if c.guestHandle() != "" {
+				c.kick("Guest session expired")
+			}
+		})
+		defer expiry.Stop()
+	}
 
 	for {
 		mt, data, err := ws.ReadMessage()
-		l := log.WithFields(logrus.Fields{"mt": mt, "data": data, "err": err})
+		l := log.WithFields(logrus.Fields{"mt": mt, "data": data, "err": err, "conn": c.id, "tenant": t.name()})
 		if err != nil {
-			if websocket.IsCloseError(err, websocket.CloseGoingAway) || err == io.EOF {
+			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) || err == io.EOF {
 				l.Info("Websocket closed!")
-				break
+			} else {
+				l.Error("Error reading websocket message")
 			}
-			l.Error("Error reading websocket message")
+			break
 		}
 		switch mt {
 		case websocket.TextMessage:
+			messagesIn.inc(instance)
+			receive := tracer.start("chat.receive", spanContext{})
+			validate := tracer.start("chat.validate", receive.context())
 			msg, err := validateMessage(data)
+			validate.finish(err)
 			if err != nil {
 				l.WithFields(logrus.Fields{"msg": msg, "err": err}).Error("Invalid Message")
+				rejectedMessages.inc(instance, rejectInvalid)
+				receive.finish(err)
+				break
+			}
+			if c.isPending() {
+				l.Warning("Message from a connection waiting for approval")
+				rejectedMessages.inc(instance, rejectPending)
+				receive.finish(errors.New("pending approval"))
+				break
+			}
+			if c.invite == "" && rooms.get(t).Private {
+				l.Warning("Message from a non-member of a private room")
+				rejectedMessages.inc(instance, rejectPrivate)
+				receive.finish(errors.New("private room"))
+				go c.kick("Private room")
+				break
+			}
+			if bans.banned(t, msg.Handle, "") {
+				l.WithField("handle", msg.Handle).Warning("Message from banned handle")
+				rejectedMessages.inc(instance, rejectBanned)
+				receive.finish(errors.New("banned"))
+				go c.kick("Banned")
+				break
+			}
+			if guest := c.guestHandle(); guest != "" {
+				if msg.Type != messageUpvote && msg.Handle != guest {
+					l.WithField("handle", msg.Handle).Warning("Guest used another handle")
+					rejectedMessages.inc(instance, rejectHandle)
+					receive.finish(errors.New("handle mismatch"))
+					break
+				}
+				if containsLink(msg.Text) {
+					l.WithField("handle", guest).Warning("Guest posted a link")
+					rejectedMessages.inc(instance, rejectGuestLink)
+					receive.finish(errors.New("guest link"))
+					break
+				}
+				if ok, err := allowGuestMessage(rr.pool, t, guest); err != nil {
+					l.WithField("err", err).Error("Unable to check guest rate limit")
+				} else if !ok {
+					l.WithField("handle", guest).Warning("Guest rate limit exceeded")
+					rejectedMessages.inc(instance, rejectGuestRate)
+					receive.finish(errors.New("guest rate limit"))
+					break
+				}
+			}
+			room := rooms.get(t)
+			if room.ReadOnly {
+				l.Warning("Message in a read-only room")
+				rejectedMessages.inc(instance, rejectReadOnly)
+				receive.finish(errors.New("read-only room"))
+				break
+			}
+			if ok, err := t.allowMessage(rr.pool); err != nil {
+				l.WithField("err", err).Error("Unable to check message quota")
+			} else if !ok {
+				l.Warning("Tenant message quota exceeded")
+				rejectedMessages.inc(instance, rejectQuota)
+				receive.finish(errors.New("quota exceeded"))
+				break
+			}
+			// Slow mode comes last so that messages rejected for another
+			// reason don't use up the sender's slot.
+			if ok, err := room.allowPost(rr.pool, t, c.poster()); err != nil {
+				l.WithField("err", err).Error("Unable to check slow mode")
+			} else if !ok {
+				l.Warning("Message sent too soon in slow mode")
+				rejectedMessages.inc(instance, rejectSlowMode)
+				receive.finish(errors.New("slow mode"))
+				break
+			}
+			c.seen(msg)
+			if room.Mode == roomModeQA {
+				err := handleQA(rr.pool, t, c, msg)
+				if errors.Cause(err) == errStorageQuota {
+					l.Warning("Tenant storage quota exceeded")
+					rejectedMessages.inc(instance, rejectStorage)
+				} else if errors.Cause(err) == errQuestionClosed {
+					l.WithField("err", err).Info("Question already closed")
+					rejectedMessages.inc(instance, rejectQuestionClosed)
+				} else if err != nil {
+					l.WithField("err", err).Warning("Rejected Q&A message")
+					rejectedMessages.inc(instance, rejectInvalid)
+				}
+				receive.finish(err)
+				break
+			}
+			if msg.Type == messageSnippet {
+				err := handleSnippet(rr.pool, t, msg)
+				if errors.Cause(err) == errStorageQuota {
+					l.Warning("Tenant storage quota exceeded")
+					rejectedMessages.inc(instance, rejectStorage)
+				} else if err != nil {
+					l.WithField("err", err).Error("Unable to publish snippet")
+				}
+				receive.finish(err)
+				break
+			}
+			if msg.Type != "" {
+				l.WithField("type", msg.Type).Warning("Q&A message outside of Q&A mode")
+				rejectedMessages.inc(instance, rejectInvalid)
+				receive.finish(errors.New("not in Q&A mode"))
+				break
+			}
+			data, err = json.Marshal(newChatMessage(t, msg))
+			if err != nil {
+				l.WithField("err", err).Error("Unable to encode message")
+				receive.finish(err)
 				break
 			}
-			rw.publish(data)
+			enqueue := tracer.start("chat.enqueue", receive.context())
+			rw.publish(t, injectTraceContext(data, enqueue.context()))
+			enqueue.finish(nil)
+			receive.finish(nil)
 		default:
 			l.Warning("Unknown Message!")
+			rejectedMessages.inc(instance, rejectUnknownType)
 		}
 	}
 
-	rr.deRegister(ws)
+	rr.deRegister(c)
 
-	ws.WriteMessage(websocket.CloseMessage, []byte{})
+	// The writer may still be writing, and only control frames can be
+	// written concurrently.
+	ws.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Second))
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialChat connects a websocket client to the chat with the provided query.
+// The connection is closed, and deregistered from the hub, when the test
+// ends.
+func dialChat(t *testing.T, query string) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+query, nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ws.Close()
+		waitFor(t, "the connection to be deregistered", func() bool {
+			n, _ := rr.probe(time.Second)
+			return n == 0
+		})
+		server.Close()
+	})
+	return ws
+}
+
+// metricValue returns the value of the series of f with the provided label
+// values.
+func metricValue(f *metricFamily, labelValues ...string) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.get(labelValues).value
+}
+
+func TestSlowModeAfterOtherRejections(t *testing.T) {
+	fake, pool := testHub(t)
+	acme := &tenant{ID: "acme", Token: "acme-token", MessagesPerMinute: 1}
+	useTenants(t, acme)
+	if err := saveRoom(pool, acme, roomSettings{SlowModeSeconds: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rooms.load(pool, acme); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fake.flush()
+		rooms.load(pool, acme)
+	})
+
+	// Use up the tenant's message quota.
+	if ok, err := acme.allowMessage(pool); !ok || err != nil {
+		t.Fatalf("allowMessage = %v, %v", ok, err)
+	}
+
+	ws := dialChat(t, "?tenant_token=acme-token")
+	send := func(text string) {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"handle":"ann","text":"`+text+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quota := metricValue(rejectedMessages, instance, rejectQuota)
+	slow := metricValue(rejectedMessages, instance, rejectSlowMode)
+
+	send("over the quota")
+	waitFor(t, "the quota rejection", func() bool {
+		return metricValue(rejectedMessages, instance, rejectQuota) == quota+1
+	})
+
+	// Lift the quota: the rejected message didn't use up the slow mode slot.
+	tenants.mu.Lock()
+	tenants.tenants["acme"] = &tenant{ID: "acme", Token: "acme-token"}
+	tenants.mu.Unlock()
+	send("first")
+	waitFor(t, "the message to be published", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.published) == 1
+	})
+
+	send("second")
+	waitFor(t, "the slow mode rejection", func() bool {
+		return metricValue(rejectedMessages, instance, rejectSlowMode) == slow+1
+	})
+}
+
+func TestChatMessageIsRebuilt(t *testing.T) {
+	fake, _ := testHub(t)
+	useTenants(t)
+	ws := dialChat(t, "")
+	// encoding/json matches keys case-insensitively and keeps the last
+	// duplicate, so the server sees a chat message where a browser sees a
+	// snippet.
+	frame := `{"type":"snippet","Type":"","handle":"a","text":"b","id":"1","timestamp":5,"html":"<img src=x onerror=alert(1)>"}`
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+	var published string
+	waitFor(t, "the message to be published", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if len(fake.published) == 0 {
+			return false
+		}
+		published = fake.published[0].data
+		return true
+	})
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(published), &got); err != nil {
+		t.Fatal(err)
+	}
+	delete(got, traceparentField)
+	want := map[string]interface{}{"handle": "a", "text": "b", "id": "1", "timestamp": float64(5)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("published %s, want %v", published, want)
+	}
+}
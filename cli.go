@@ -0,0 +1,754 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/heroku/x/hredis/redigo"
+	"github.com/pkg/errors"
+)
+
+// command is a subcommand of the binary, such as `users kick`.
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags]", "Serve the chat application (the default)", runServe},
+		{"config print", "", "Print the effective configuration, secrets redacted", runConfigPrint},
+		{"config print-defaults", "", "Print the default configuration as a documented TOML file", runConfigPrintDefaults},
+		{"users list", "[-json] [-tenant id]", "List connections across the cluster", runUsersList},
+		{"users kick", "<id>", "Disconnect a connection, on whichever instance it lives", runUsersKick},
+		{"users approve", "<id>", "Let a connection waiting for approval into its room", runUsersApprove},
+		{"users upgrade", "<id>", "Make a widget guest a full member", runUsersUpgrade},
+		{"rooms list", "[-json] [-tenant id]", "List the rooms of the tenants and their connections", runRoomsList},
+		{"ban add", "[-tenant id] <handle|address>", "Ban a handle or remote address", runBanAdd},
+		{"ban remove", "[-tenant id] <handle|address>", "Lift a ban", runBanRemove},
+		{"ban list", "[-json] [-tenant id]", "List bans", runBanList},
+		{"broadcast", "[-tenant id] <text>", "Broadcast a system announcement", runBroadcast},
+		{"tenants list", "[-json]", "List tenants, their tokens and quotas", runTenantsList},
+		{"tenants set", "[-max-connections n] [-max-guests n] [-messages-per-minute n] [-max-storage-bytes n] <id>", "Create or update a tenant", runTenantsSet},
+		{"tenants remove", "<id>", "Remove a tenant and all of its data", runTenantsRemove},
+		{"keys create", "[-json] [-admin] <tenant> | -site [-tenant id] <origin>...", "Issue a new tenant token, replacing the current one, or a widget site key", runKeysCreate},
+		{"doctor", "[-json]", "Check Redis connectivity, TLS, latency and configuration", runDoctor},
+	}
+}
+
+// runCommand runs the subcommand named by args, or serves if args is empty
+// or only contains flags.
+func runCommand(args []string) error {
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help") {
+		return runServe(args)
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(os.Stdout)
+		return nil
+	}
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			if c.name != "serve" {
+				// Other commands take their configuration from the
+				// environment and CONFIG_FILE only, leaving flags to them.
+				conf, _, err := loadConfig(c.name, nil)
+				if err != nil {
+					return err
+				}
+				currentConfig.Store(conf)
+				defer closeCLIPool()
+			}
+			return c.run(args[len(words):])
+		}
+	}
+	usage(os.Stderr)
+	return errors.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: go-websocket-chat-demo [command]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.usage)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands other than serve talk to the cluster through REDIS_URL.")
+	fmt.Fprintln(w, "Run `serve -h` to list the settings, which can also be set in the")
+	fmt.Fprintln(w, "environment or in a YAML or TOML file named by -config or CONFIG_FILE.")
+}
+
+// parseFlags parses the -json flag shared by the listing commands and
+// returns the remaining arguments.
+func parseFlags(name string, args []string) (jsonOut bool, rest []string, err error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.BoolVar(&jsonOut, "json", false, "Print JSON instead of text")
+	if err := fs.Parse(args); err != nil {
+		return false, nil, err
+	}
+	return jsonOut, fs.Args(), nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// parseTenantFlags parses the -json and -tenant flags and returns the tenants
+// named by -tenant, or every tenant if it isn't set, and the remaining
+// arguments.
+func parseTenantFlags(name string, args []string) (ts []*tenant, jsonOut bool, rest []string, err error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.BoolVar(&jsonOut, "json", false, "Print JSON instead of text")
+	id := fs.String("tenant", "", "Only act on the tenant with this `id`")
+	if err := fs.Parse(args); err != nil {
+		return nil, false, nil, err
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if err := tenants.load(pool); err != nil {
+		return nil, false, nil, err
+	}
+	if *id == "" {
+		return tenants.all(), jsonOut, fs.Args(), nil
+	}
+	t := tenants.get(*id)
+	if t == nil {
+		return nil, false, nil, errors.Errorf("no tenant %q", *id)
+	}
+	return []*tenant{t}, jsonOut, fs.Args(), nil
+}
+
+// parseTenantFlag is parseTenantFlags for commands acting on a single tenant,
+// the default one unless -tenant is set.
+func parseTenantFlag(name string, args []string) (t *tenant, jsonOut bool, rest []string, err error) {
+	ts, jsonOut, rest, err := parseTenantFlags(name, args)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if len(ts) > 1 {
+		return defaultTenant, jsonOut, rest, nil
+	}
+	return ts[0], jsonOut, rest, nil
+}
+
+// allClusterClients lists the connections of ts across the cluster.
+func allClusterClients(ts []*tenant) ([]clientInfo, error) {
+	pool, err := cliPool()
+	if err != nil {
+		return nil, err
+	}
+	var clients []clientInfo
+	for _, t := range ts {
+		cluster, err := clusterClients(pool, t)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, cluster...)
+	}
+	return clients, nil
+}
+
+// cliRedis is the Redis pool of the running command.
+var cliRedis *redis.Pool
+
+// cliPool returns the Redis pool of the running command, creating it on
+// first use. runCommand closes it once the command returns.
+func cliPool() (*redis.Pool, error) {
+	if cliRedis == nil {
+		pool, err := redigo.NewRedisPoolFromURL(cfg().RedisURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to create Redis pool")
+		}
+		cliRedis = pool
+	}
+	return cliRedis, nil
+}
+
+func closeCLIPool() {
+	if cliRedis != nil {
+		cliRedis.Close()
+		cliRedis = nil
+	}
+}
+
+func runServe(args []string) error {
+	conf, rest, err := loadConfig("serve", args)
+	if err == flag.ErrHelp {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.Errorf("unexpected arguments %q", rest)
+	}
+	serve(conf, args)
+	return nil
+}
+
+func runConfigPrint(_ []string) error {
+	cfg().writeTOML(os.Stdout, true)
+	return nil
+}
+
+func runConfigPrintDefaults(_ []string) error {
+	defaultConfig().writeTOML(os.Stdout, false)
+	return nil
+}
+
+func runUsersList(args []string) error {
+	ts, jsonOut, _, err := parseTenantFlags("users list", args)
+	if err != nil {
+		return err
+	}
+	clients, err := allClusterClients(ts)
+	if err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(clients)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTENANT\tINSTANCE\tHANDLE\tREMOTE ADDRESS\tCONNECTED\tRECEIVED")
+	for _, c := range clients {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", c.ID, tenants.get(c.Tenant).name(), c.Instance, c.Handle, c.RemoteAddr,
+			c.ConnectedAt.Format(time.RFC3339), c.Received)
+	}
+	return tw.Flush()
+}
+
+func runUsersKick(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: users kick <id>")
+	}
+	if err := controlConnection(opDisconnect, args[0]); err != nil {
+		return err
+	}
+	fmt.Println("Disconnect requested for", args[0])
+	return nil
+}
+
+func runUsersApprove(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: users approve <id>")
+	}
+	if err := controlConnection(opApprove, args[0]); err != nil {
+		return err
+	}
+	fmt.Println("Approval requested for", args[0])
+	return nil
+}
+
+func runUsersUpgrade(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: users upgrade <id>")
+	}
+	if err := controlConnection(opUpgrade, args[0]); err != nil {
+		return err
+	}
+	fmt.Println("Upgrade requested for", args[0])
+	return nil
+}
+
+// controlConnection publishes op for the connection with the provided id,
+// looked up across tenants.
+func controlConnection(op, id string) error {
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	if err := tenants.load(pool); err != nil {
+		return err
+	}
+	clients, err := allClusterClients(tenants.all())
+	if err != nil {
+		return err
+	}
+	for _, c := range clients {
+		if c.ID == id {
+			return publishControl(pool, controlCommand{Op: op, ID: c.ID, Tenant: c.Tenant})
+		}
+	}
+	return errors.Errorf("no connection %q", id)
+}
+
+// roomInfo describes a tenant's room: its channel, mode and the connections
+// recorded in the registry, and the instances holding them.
+type roomInfo struct {
+	Tenant      string `json:"tenant"`
+	Channel     string `json:"channel"`
+	Mode        string `json:"mode,omitempty"`
+	Connections int    `json:"connections"`
+	Instances   int    `json:"instances"`
+}
+
+// runRoomsList lists the rooms of the tenants. Tenant channels are joined
+// with a pattern subscription, which PUBSUB CHANNELS doesn't report, so the
+// rooms come from the tenants and the connection registry instead.
+func runRoomsList(args []string) error {
+	ts, jsonOut, _, err := parseTenantFlags("rooms list", args)
+	if err != nil {
+		return err
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	list := make([]roomInfo, 0, len(ts))
+	for _, t := range ts {
+		settings, err := loadRoom(pool, t)
+		if err != nil {
+			return err
+		}
+		clients, err := clusterClients(pool, t)
+		if err != nil {
+			return err
+		}
+		instances := make(map[string]bool)
+		for _, c := range clients {
+			instances[c.Instance] = true
+		}
+		list = append(list, roomInfo{
+			Tenant:      t.name(),
+			Channel:     t.channel(),
+			Mode:        settings.Mode,
+			Connections: len(clients),
+			Instances:   len(instances),
+		})
+	}
+	if jsonOut {
+		return printJSON(list)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TENANT\tCHANNEL\tMODE\tCONNECTIONS\tINSTANCES")
+	for _, r := range list {
+		mode := r.Mode
+		if mode == "" {
+			mode = "chat"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", r.Tenant, r.Channel, mode, r.Connections, r.Instances)
+	}
+	return tw.Flush()
+}
+
+func runBanAdd(args []string) error {
+	t, _, args, err := parseTenantFlag("ban add", args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("usage: ban add [-tenant id] <handle|address>")
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	if err := addBan(pool, t, args[0]); err != nil {
+		return err
+	}
+	fmt.Println("Banned", args[0])
+	return nil
+}
+
+func runBanRemove(args []string) error {
+	t, _, args, err := parseTenantFlag("ban remove", args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("usage: ban remove [-tenant id] <handle|address>")
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	if err := removeBan(pool, t, args[0]); err != nil {
+		return err
+	}
+	fmt.Println("Unbanned", args[0])
+	return nil
+}
+
+func runBanList(args []string) error {
+	t, jsonOut, _, err := parseTenantFlag("ban list", args)
+	if err != nil {
+		return err
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	entries, err := listBans(pool, t)
+	if err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(entries)
+	}
+	for _, e := range entries {
+		fmt.Println(e)
+	}
+	return nil
+}
+
+func runBroadcast(args []string) error {
+	ts, _, args, err := parseTenantFlags("broadcast", args)
+	if err != nil {
+		return err
+	}
+	text := strings.Join(args, " ")
+	if text == "" {
+		return errors.New("usage: broadcast [-tenant id] <text>")
+	}
+	data, err := json.Marshal(message{Handle: "system", Text: text})
+	if err != nil {
+		return err
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	for _, t := range ts {
+		n, err := redis.Int(conn.Do("PUBLISH", t.channel(), data))
+		if err != nil {
+			return errors.Wrap(err, "Unable to publish announcement")
+		}
+		fmt.Printf("Announcement delivered to %d instance(s) for tenant %s\n", n, t.name())
+	}
+	return nil
+}
+
+func runTenantsList(args []string) error {
+	jsonOut, _, err := parseFlags("tenants list", args)
+	if err != nil {
+		return err
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	list, err := listTenants(pool)
+	if err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(list)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMAX CONNECTIONS\tMAX GUESTS\tMESSAGES PER MINUTE\tMAX STORAGE BYTES\tTOKEN\tADMIN TOKEN")
+	for _, t := range list {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", t.ID, t.MaxConnections, t.MaxGuests, t.MessagesPerMinute, t.MaxStorageBytes, t.Token, t.AdminToken)
+	}
+	return tw.Flush()
+}
+
+// runTenantsSet creates a tenant or updates the quotas of an existing one.
+// Quotas whose flag isn't set keep their current value.
+func runTenantsSet(args []string) error {
+	var set tenant
+	fs := flag.NewFlagSet("tenants set", flag.ContinueOnError)
+	fs.IntVar(&set.MaxConnections, "max-connections", 0, "Maximum number of connections across the cluster, 0 for no limit")
+	fs.IntVar(&set.MaxGuests, "max-guests", 0, "Maximum number of widget guests across the cluster, 0 for no limit")
+	fs.IntVar(&set.MessagesPerMinute, "messages-per-minute", 0, "Maximum number of messages per minute across the cluster, 0 for no limit")
+	fs.IntVar(&set.MaxStorageBytes, "max-storage-bytes", 0, "Maximum bytes of snippets, custom emoji and questions stored, 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: tenants set [-max-connections n] [-max-guests n] [-messages-per-minute n] [-max-storage-bytes n] <id>")
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	t, err := loadTenant(pool, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		t = &tenant{ID: fs.Arg(0)}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "max-connections":
+			t.MaxConnections = set.MaxConnections
+		case "max-guests":
+			t.MaxGuests = set.MaxGuests
+		case "messages-per-minute":
+			t.MessagesPerMinute = set.MessagesPerMinute
+		case "max-storage-bytes":
+			t.MaxStorageBytes = set.MaxStorageBytes
+		}
+	})
+	if err := saveTenant(pool, t); err != nil {
+		return err
+	}
+	return printJSON(t)
+}
+
+func runTenantsRemove(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tenants remove <id>")
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+	if err := removeTenant(pool, args[0]); err != nil {
+		return err
+	}
+	fmt.Println("Removed tenant", args[0])
+	return nil
+}
+
+// createdKey describes a key issued by keys create.
+type createdKey struct {
+	Kind   string `json:"kind"`
+	Tenant string `json:"tenant"`
+	Key    string `json:"key"`
+}
+
+// runKeysCreate issues a new chat or admin token for a tenant, which
+// replaces its current one across the cluster, or a widget site key for the
+// provided origins. The default tenant is selected by host and only has
+// site keys.
+func runKeysCreate(args []string) error {
+	const usage = "usage: keys create [-json] [-admin] <tenant> | keys create [-json] -site [-tenant id] <origin>..."
+	fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "Print JSON instead of text")
+	admin := fs.Bool("admin", false, "Issue the tenant's admin token instead of its chat token")
+	siteKey := fs.Bool("site", false, "Issue a widget site key for the origins")
+	id := fs.String("tenant", "", "Tenant of the site key, the default one unless set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pool, err := cliPool()
+	if err != nil {
+		return err
+	}
+
+	var key createdKey
+	switch {
+	case *siteKey:
+		if fs.NArg() == 0 || *admin {
+			return errors.New(usage)
+		}
+		if *id != "" {
+			if t, err := loadTenant(pool, *id); err != nil {
+				return err
+			} else if t == nil {
+				return errors.Errorf("no tenant %q", *id)
+			}
+		}
+		s := &site{Tenant: *id, Origins: fs.Args()}
+		if err := saveSite(pool, s); err != nil {
+			return err
+		}
+		key = createdKey{Kind: "site", Tenant: (&tenant{ID: *id}).name(), Key: s.Key}
+	default:
+		if fs.NArg() != 1 || *id != "" {
+			return errors.New(usage)
+		}
+		t, err := loadTenant(pool, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return errors.Errorf("no tenant %q", fs.Arg(0))
+		}
+		key = createdKey{Kind: "token", Tenant: t.ID, Key: newToken()}
+		if *admin {
+			key.Kind = "admin token"
+			t.AdminToken = key.Key
+		} else {
+			t.Token = key.Key
+		}
+		if err := saveTenant(pool, t); err != nil {
+			return err
+		}
+	}
+	if *jsonOut {
+		return printJSON(key)
+	}
+	fmt.Printf("Created %s for tenant %s: %s\n", key.Kind, key.Tenant, key.Key)
+	return nil
+}
+
+// Doctor check results.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+func runDoctor(args []string) error {
+	jsonOut, _, err := parseFlags("doctor", args)
+	if err != nil {
+		return err
+	}
+
+	results := checkConfig()
+	results = append(results, checkRedis(cfg().RedisURL)...)
+
+	failed := false
+	for _, r := range results {
+		if r.Status == checkFail {
+			failed = true
+		}
+	}
+	if jsonOut {
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range results {
+			fmt.Printf("[%-4s] %s: %s\n", r.Status, r.Name, r.Detail)
+		}
+	}
+	if failed {
+		return errors.New("one or more checks failed")
+	}
+	return nil
+}
+
+// checkConfig reports on the configuration. It has already been validated
+// when the command started, so this only flags settings that are valid but
+// likely to be a mistake.
+func checkConfig() []checkResult {
+	c := cfg()
+	results := []checkResult{
+		{"Configuration", checkOK, "valid"},
+	}
+
+	switch {
+	case c.AdminToken == "":
+		results = append(results, checkResult{"Admin token", checkWarn, "not set, the admin surface is disabled"})
+	case len(c.AdminToken) < 16:
+		results = append(results, checkResult{"Admin token", checkWarn, "shorter than 16 characters"})
+	default:
+		results = append(results, checkResult{"Admin token", checkOK, "set"})
+	}
+
+	if c.ReadyDisconnectThreshold <= c.ReconnectDelay {
+		results = append(results, checkResult{"Readiness", checkWarn, "ready_disconnect_threshold is not longer than reconnect_delay, a single reconnect fails readiness"})
+	}
+	return results
+}
+
+// checkRedis checks connectivity, TLS and latency of the Redis server at
+// rawurl.
+func checkRedis(rawurl string) []checkResult {
+	var results []checkResult
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return results
+	}
+	results = append(results, checkTLS(u))
+
+	start := time.Now()
+	conn, err := redis.DialURL(rawurl, redis.DialConnectTimeout(5*time.Second), redis.DialTLSSkipVerify(true))
+	if err != nil {
+		return append(results, checkResult{"Redis connectivity", checkFail, err.Error()})
+	}
+	defer conn.Close()
+	results = append(results, checkResult{"Redis connectivity", checkOK, "connected in " + time.Since(start).String()})
+
+	const pings = 10
+	var total, max time.Duration
+	for i := 0; i < pings; i++ {
+		start := time.Now()
+		if _, err := conn.Do("PING"); err != nil {
+			return append(results, checkResult{"Redis latency", checkFail, err.Error()})
+		}
+		d := time.Since(start)
+		total += d
+		if d > max {
+			max = d
+		}
+	}
+	avg := total / pings
+	status := checkOK
+	if avg > 50*time.Millisecond {
+		status = checkWarn
+	}
+	results = append(results, checkResult{"Redis latency", status, fmt.Sprintf("avg %s, max %s over %d PINGs", avg, max, pings)})
+
+	instances, err := redis.Strings(conn.Do("SMEMBERS", redisKey("instances")))
+	if err != nil {
+		return append(results, checkResult{"Cluster", checkWarn, err.Error()})
+	}
+	return append(results, checkResult{"Cluster", checkOK, fmt.Sprintf("%d instance(s) registered: %s", len(instances), strings.Join(instances, ", "))})
+}
+
+// checkTLS reports whether the connection to Redis is encrypted and whether
+// the server's certificate verifies and is close to expiring.
+func checkTLS(u *url.URL) checkResult {
+	host := u.Hostname()
+	if u.Scheme != "rediss" {
+		if host == "localhost" || host == "127.0.0.1" || host == "::1" {
+			return checkResult{"Redis TLS", checkOK, "not used for a local server"}
+		}
+		return checkResult{"Redis TLS", checkWarn, "not used, traffic to Redis is unencrypted"}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(host, "6379")
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	if err != nil {
+		// Managed Redis providers, Heroku included, commonly use self signed
+		// certificates, so only fail if the handshake itself is impossible.
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return checkResult{"Redis TLS", checkFail, err.Error()}
+		}
+		conn.Close()
+		return checkResult{"Redis TLS", checkWarn, "handshake succeeded but the certificate does not verify"}
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return checkResult{"Redis TLS", checkWarn, "no certificate presented"}
+	}
+	left := time.Until(certs[0].NotAfter)
+	switch {
+	case left <= 0:
+		return checkResult{"Redis TLS", checkFail, "certificate expired"}
+	case left < 14*24*time.Hour:
+		return checkResult{"Redis TLS", checkWarn, fmt.Sprintf("certificate expires in %d days", int(left.Hours()/24))}
+	}
+	return checkResult{"Redis TLS", checkOK, "certificate valid until " + certs[0].NotAfter.Format("2006-01-02")}
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+// useCLIPool makes the commands use pool.
+func useCLIPool(t *testing.T) {
+	fake, pool := testHub(t)
+	cliRedis = pool
+	t.Cleanup(func() {
+		cliRedis = nil
+		fake.flush()
+	})
+}
+
+func TestTenantsSetKeepsUnsetQuotas(t *testing.T) {
+	useCLIPool(t)
+	if err := runTenantsSet([]string{"-max-connections", "10", "-max-guests", "5", "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runTenantsSet([]string{"-max-guests", "7", "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadTenant(cliRedis, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MaxConnections != 10 || got.MaxGuests != 7 {
+		t.Errorf("tenant = %+v, want 10 connections and 7 guests", got)
+	}
+	if got.Token == "" || got.AdminToken == "" {
+		t.Errorf("tenant %+v has no tokens", got)
+	}
+}
+
+func TestKeysCreate(t *testing.T) {
+	useCLIPool(t)
+	if err := runTenantsSet([]string{"-max-connections", "10", "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := loadTenant(cliRedis, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runKeysCreate([]string{"acme"}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := loadTenant(cliRedis, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Token == before.Token || after.AdminToken != before.AdminToken || after.MaxConnections != 10 {
+		t.Errorf("after keys create: %+v, before: %+v", after, before)
+	}
+
+	if err := runKeysCreate([]string{"-admin", "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if admin, _ := loadTenant(cliRedis, "acme"); admin.AdminToken == after.AdminToken || admin.Token != after.Token {
+		t.Errorf("after keys create -admin: %+v, before: %+v", admin, after)
+	}
+
+	if err := runKeysCreate([]string{"-site", "-tenant", "acme", "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	sites, err := listSites(cliRedis, []*tenant{{ID: "acme"}})
+	if err != nil || len(sites) != 1 || sites[0].Origins[0] != "https://example.com" {
+		t.Errorf("sites = %v, %v", sites, err)
+	}
+
+	for _, args := range [][]string{{"nobody"}, {"-site"}, {"-site", "-tenant", "nobody", "https://example.com"}} {
+		if err := runKeysCreate(args); err == nil {
+			t.Errorf("keys create %q succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// client is a websocket connection along with the metadata the admin surface
+// reports about it.
+type client struct {
+	id          string
+	tenant      *tenant
+	ws          *websocket.Conn
+	remoteAddr  string
+	userAgent   string
+	connectedAt time.Time
+	invite      string        // ID of the invite the client joined with
+	send        chan outgoing // written by writeLoop, closed by the hub
+
+	mu       sync.Mutex
+	guest    string // handle issued to a widget guest, until upgraded
+	handle   string
+	received int
+	lastSeen time.Time
+	pending  bool // waiting for an administrator to approve it
+}
+
+func newClient(ws *websocket.Conn, r *http.Request, t *tenant, guest string, pending bool) *client {
+	return &client{
+		id:          newID(),
+		tenant:      t,
+		guest:       guest,
+		handle:      guest,
+		ws:          ws,
+		remoteAddr:  remoteAddr(r),
+		userAgent:   r.UserAgent(),
+		connectedAt: time.Now(),
+		lastSeen:    time.Now(),
+		pending:     pending,
+		send:        make(chan outgoing, cfg().SendQueueSize),
+	}
+}
+
+// outgoing is a message queued for a client, with the context of the trace
+// its write belongs to.
+type outgoing struct {
+	data   []byte
+	parent spanContext
+}
+
+// writeLoop writes the messages queued by the hub to the connection until
+// the hub closes the queue. Each write has to finish within the write
+// timeout.
+func (c *client) writeLoop() {
+	for out := range c.send {
+		write := tracer.start("websocket.write", out.parent)
+		write.setAttr("remote_addr", c.remoteAddr)
+		c.ws.SetWriteDeadline(time.Now().Add(cfg().WriteTimeout))
+		err := c.ws.WriteMessage(websocket.TextMessage, out.data)
+		write.finish(err)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err":  err,
+				"conn": c.id,
+			}).Error("Error writting data to connection! Closing Connection")
+			connectionWriteErrors.inc(instance)
+			// The read loop fails and deregisters the client once it is
+			// closed, until then its messages are dropped.
+			c.ws.Close()
+			for range c.send {
+			}
+			return
+		}
+		messagesOut.inc(instance)
+	}
+}
+
+// isPending returns true while the client waits for approval.
+func (c *client) isPending() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending
+}
+
+// approve lets a pending client into the room. It returns false if the
+// client wasn't pending.
+func (c *client) approve() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	was := c.pending
+	c.pending = false
+	return was
+}
+
+// seen records a message received from the client.
+func (c *client) seen(msg message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg.Handle != "" {
+		c.handle = msg.Handle
+	}
+	c.received++
+	c.lastSeen = time.Now()
+}
+
+// guestHandle returns the handle issued to a widget guest, or an empty string
+// if the client isn't a guest.
+func (c *client) guestHandle() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.guest
+}
+
+// upgrade makes a guest a full member, lifting the guest limits. It returns
+// false if the client wasn't a guest.
+func (c *client) upgrade() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	was := c.guest != ""
+	c.guest = ""
+	return was
+}
+
+// voter identifies the client when voting: by the handle issued to a widget
+// guest, or else by the remote address without its port, both of which
+// outlive the connection. Handles of other clients are chosen by the client,
+// so they can't be used. The trade-off is that clients behind the same NAT
+// or proxy share a vote.
+func (c *client) voter() string {
+	if guest := c.guestHandle(); guest != "" {
+		return "guest:" + guest
+	}
+	return "addr:" + c.remoteAddr
+}
+
+// poster identifies the client in slow mode, like voter, so that neither
+// reconnecting nor opening more connections gets around it.
+func (c *client) poster() string {
+	return c.voter()
+}
+
+// clientInfo is the JSON representation of a client.
+type clientInfo struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Instance    string    `json:"instance"`
+	Handle      string    `json:"handle,omitempty"`
+	Guest       bool      `json:"guest,omitempty"`
+	Pending     bool      `json:"pending,omitempty"`
+	Invite      string    `json:"invite,omitempty"`
+	RemoteAddr  string    `json:"remote_addr"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+	Received    int       `json:"received"`
+}
+
+func (c *client) info() clientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return clientInfo{
+		ID:          c.id,
+		Tenant:      c.tenant.ID,
+		Instance:    instance,
+		Handle:      c.handle,
+		Guest:       c.guest != "",
+		Pending:     c.pending,
+		Invite:      c.invite,
+		RemoteAddr:  c.remoteAddr,
+		UserAgent:   c.userAgent,
+		ConnectedAt: c.connectedAt,
+		LastSeen:    c.lastSeen,
+		Received:    c.received,
+	}
+}
+
+// kick closes the connection with the provided reason. The read loop notices
+// the closed connection and deregisters the client.
+func (c *client) kick(reason string) {
+	deadline := time.Now().Add(time.Second)
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), deadline)
+	c.ws.Close()
+}
+
+// newID returns a random identifier for a client.
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newToken returns a random secret.
+func newToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// remoteAddr of the request, without port, preferring the address reported
+// by the Heroku router or any other proxy in front of us. The proxy appends
+// the address it got the request from to X-Forwarded-For, so only the last
+// hop is trusted: the entries before it are whatever the client sent.
+func remoteAddr(r *http.Request) string {
+	if fwd := r.Header["X-Forwarded-For"]; len(fwd) > 0 {
+		hops := strings.Split(fwd[len(fwd)-1], ",")
+		if last := strings.TrimSpace(hops[len(hops)-1]); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
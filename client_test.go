@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientVoter(t *testing.T) {
+	newTestClient := func(remote, forwarded, guest string) *client {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = remote
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return newClient(nil, r, defaultTenant, guest, false)
+	}
+	tests := []struct {
+		client *client
+		want   string
+	}{
+		{newTestClient("192.0.2.1:5000", "", ""), "addr:192.0.2.1"},
+		{newTestClient("192.0.2.1:5001", "", ""), "addr:192.0.2.1"},
+		{newTestClient("[2001:db8::1]:5000", "", ""), "addr:2001:db8::1"},
+		{newTestClient("10.0.0.1:5000", "198.51.100.7", ""), "addr:198.51.100.7"},
+		// A made-up leftmost entry doesn't make another voter.
+		{newTestClient("10.0.0.1:5000", "203.0.113.9, 198.51.100.7", ""), "addr:198.51.100.7"},
+		{newTestClient("192.0.2.1:5000", "", "guest-abc123"), "guest:guest-abc123"},
+	}
+	for _, tt := range tests {
+		if got := tt.client.voter(); got != tt.want {
+			t.Errorf("voter of %s = %q, want %q", tt.client.remoteAddr, got, tt.want)
+		}
+	}
+
+	// Neither a reconnection from the same address nor a spoofed
+	// X-Forwarded-For gets another vote.
+	_, pool := testHub(t)
+	if err := askQuestion(pool, defaultTenant, "ann", "Is it recorded?", tests[0].client.voter()); err != nil {
+		t.Fatal(err)
+	}
+	qs, err := listQuestions(pool, defaultTenant)
+	if err != nil || len(qs) != 1 {
+		t.Fatalf("listQuestions = %v, %v", qs, err)
+	}
+	for _, c := range []*client{tests[0].client, tests[1].client, tests[3].client, tests[4].client} {
+		if err := upvoteQuestion(pool, defaultTenant, qs[0].ID, c.voter()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if qs, _ = listQuestions(pool, defaultTenant); qs[0].Votes != 2 {
+		t.Errorf("votes = %d, want one per address, 2", qs[0].Votes)
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	tests := []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"192.0.2.1:5000", nil, "192.0.2.1"},
+		{"[2001:db8::1]:5000", nil, "2001:db8::1"},
+		{"10.0.0.1:5000", []string{"198.51.100.7"}, "198.51.100.7"},
+		// Entries before the proxy's are made up by the client.
+		{"10.0.0.1:5000", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.1:5000", []string{"203.0.113.9", "198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.1:5000", []string{""}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = tt.remote
+		for _, f := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := remoteAddr(r); got != tt.want {
+			t.Errorf("remoteAddr(%s, %q) = %q, want %q", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// config holds every tunable of the server. Each field is settable, in
+// increasing order of precedence, from the config file (key tag), the
+// environment (env tag) and command line flags (the key with dashes). Fields
+// tagged reload can be changed while the server is running.
+type config struct {
+	Port      string `key:"port" env:"PORT" help:"Port to serve HTTP and websockets on"`
+	RedisURL  string `key:"redis_url" env:"REDIS_URL" secret:"true" help:"Redis server to use for pub/sub and state"`
+	LogLevel  string `key:"log_level" env:"LOG_LEVEL" reload:"true" help:"Log level: panic, fatal, error, warning, info, debug or trace"`
+	AdminPort string `key:"admin_port" env:"ADMIN_PORT" help:"Serve the admin surface on this port instead of under /admin/"`
+
+	AdminToken string `key:"admin_token" env:"ADMIN_TOKEN" secret:"true" help:"Token required by the admin surface, which is disabled when empty"`
+
+	WidgetSecret   string        `key:"widget_secret" env:"WIDGET_SECRET" secret:"true" help:"Key signing widget guest tokens, widgets are disabled when empty"`
+	WidgetTokenTTL time.Duration `key:"widget_token_ttl" env:"WIDGET_TOKEN_TTL" reload:"true" help:"How long a widget guest token is valid, and a guest session lasts"`
+
+	InviteSecret string `key:"invite_secret" env:"INVITE_SECRET" secret:"true" help:"Key signing invite links to private rooms, invites are disabled when empty"`
+
+	MaxTextBytes         int           `key:"max_text_bytes" env:"MAX_TEXT_BYTES" reload:"true" help:"Maximum size of the text of a chat message"`
+	MaxSnippetBytes      int           `key:"max_snippet_bytes" env:"MAX_SNIPPET_BYTES" reload:"true" help:"Maximum size of a code snippet"`
+	SnippetCollapseLines int           `key:"snippet_collapse_lines" env:"SNIPPET_COLLAPSE_LINES" reload:"true" help:"Snippets with more lines are sent collapsed to this many"`
+	SnippetTTL           time.Duration `key:"snippet_ttl" env:"SNIPPET_TTL" reload:"true" help:"How long the raw text of snippets is kept"`
+
+	TranscriptDir            string        `key:"transcript_dir" env:"TRANSCRIPT_DIR" help:"Directory for the transcripts of rooms that keep one, transcripts are disabled when empty"`
+	TranscriptMaxBytes       int           `key:"transcript_max_bytes" env:"TRANSCRIPT_MAX_BYTES" reload:"true" help:"Rotate a transcript once it reaches this size"`
+	TranscriptRotateInterval time.Duration `key:"transcript_rotate_interval" env:"TRANSCRIPT_ROTATE_INTERVAL" reload:"true" help:"Rotate a transcript once it is this old"`
+	TranscriptRetention      time.Duration `key:"transcript_retention" env:"TRANSCRIPT_RETENTION" reload:"true" help:"How long rotated transcripts are kept"`
+	TranscriptQueueSize      int           `key:"transcript_queue_size" env:"TRANSCRIPT_QUEUE_SIZE" help:"Messages buffered for the transcripts; under load further messages are dropped from them and a line counting them is written instead"`
+
+	GuestMessagesPerMinute int `key:"guest_messages_per_minute" env:"GUEST_MESSAGES_PER_MINUTE" reload:"true" help:"Messages a widget guest may send per minute"`
+	GuestTokensPerHour     int `key:"guest_tokens_per_hour" env:"GUEST_TOKENS_PER_HOUR" reload:"true" help:"Guest tokens a site issues to an address per hour"`
+
+	OTLPEndpoint       string `key:"otlp_endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" help:"OTLP/HTTP collector base URL, tracing is disabled when empty"`
+	OTLPTracesEndpoint string `key:"otlp_traces_endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT" help:"Full OTLP/HTTP traces URL, overrides otlp_endpoint"`
+	ServiceName        string `key:"service_name" env:"OTEL_SERVICE_NAME" help:"Service name reported in traces"`
+
+	ReadBufferSize     int `key:"read_buffer_size" env:"READ_BUFFER_SIZE" help:"Websocket read buffer size in bytes"`
+	WriteBufferSize    int `key:"write_buffer_size" env:"WRITE_BUFFER_SIZE" help:"Websocket write buffer size in bytes"`
+	BroadcastQueueSize int `key:"broadcast_queue_size" env:"BROADCAST_QUEUE_SIZE" help:"Messages buffered for broadcast to websocket clients"`
+	PublishQueueSize   int `key:"publish_queue_size" env:"PUBLISH_QUEUE_SIZE" help:"Messages buffered for publishing to Redis"`
+	SendQueueSize      int `key:"send_queue_size" env:"SEND_QUEUE_SIZE" help:"Messages buffered for each websocket client, which is disconnected when they overflow"`
+
+	WaitTimeout              time.Duration `key:"wait_timeout" env:"WAIT_TIMEOUT" reload:"true" help:"Give up and exit if Redis is unavailable for this long"`
+	WaitSleep                time.Duration `key:"wait_sleep" env:"WAIT_SLEEP" reload:"true" help:"Delay between attempts to reach Redis while waiting for it"`
+	ReconnectDelay           time.Duration `key:"reconnect_delay" env:"RECONNECT_DELAY" reload:"true" help:"Delay before reconnecting after a Redis error"`
+	ReadyDisconnectThreshold time.Duration `key:"ready_disconnect_threshold" env:"READY_DISCONNECT_THRESHOLD" reload:"true" help:"Report not ready once Redis has been disconnected for this long"`
+	WriteTimeout             time.Duration `key:"write_timeout" env:"WRITE_TIMEOUT" reload:"true" help:"Time a write to a websocket client has to complete"`
+	HubProbeTimeout          time.Duration `key:"hub_probe_timeout" env:"HUB_PROBE_TIMEOUT" reload:"true" help:"Time the hub loop has to answer a readiness probe"`
+	DrainTimeout             time.Duration `key:"drain_timeout" env:"DRAIN_TIMEOUT" reload:"true" help:"Maximum time to wait for the outbox to empty on shutdown"`
+	RegistryInterval         time.Duration `key:"registry_interval" env:"REGISTRY_INTERVAL" reload:"true" help:"How often connections are recorded in Redis for the admin surface"`
+	AdminEventInterval       time.Duration `key:"admin_event_interval" env:"ADMIN_EVENT_INTERVAL" reload:"true" help:"How often the admin dashboard is updated"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Port:                     "8080",
+		RedisURL:                 "redis://localhost:6379",
+		LogLevel:                 "info",
+		ServiceName:              "go-websocket-chat-demo",
+		ReadBufferSize:           1024,
+		WriteBufferSize:          1024,
+		BroadcastQueueSize:       1000,
+		PublishQueueSize:         10000,
+		SendQueueSize:            256,
+		WaitTimeout:              10 * time.Minute,
+		WaitSleep:                10 * time.Second,
+		ReconnectDelay:           5 * time.Second,
+		ReadyDisconnectThreshold: 30 * time.Second,
+		WriteTimeout:             10 * time.Second,
+		HubProbeTimeout:          time.Second,
+		DrainTimeout:             20 * time.Second,
+		RegistryInterval:         10 * time.Second,
+		AdminEventInterval:       2 * time.Second,
+		WidgetTokenTTL:           time.Hour,
+		GuestMessagesPerMinute:   10,
+		GuestTokensPerHour:       20,
+		MaxTextBytes:             4096,
+		MaxSnippetBytes:          64 * 1024,
+		SnippetCollapseLines:     25,
+		SnippetTTL:               7 * 24 * time.Hour,
+		TranscriptMaxBytes:       64 << 20,
+		TranscriptRotateInterval: 24 * time.Hour,
+		TranscriptRetention:      90 * 24 * time.Hour,
+		TranscriptQueueSize:      10000,
+	}
+}
+
+var currentConfig atomic.Value // *config
+
+func init() {
+	currentConfig.Store(defaultConfig())
+}
+
+// cfg returns the configuration in effect.
+func cfg() *config {
+	return currentConfig.Load().(*config)
+}
+
+// configField is a field of config along with its tags.
+type configField struct {
+	key        string
+	env        string
+	help       string
+	secret     bool
+	reloadable bool
+	value      reflect.Value
+}
+
+func (c *config) fields() []configField {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fields = append(fields, configField{
+			key:        f.Tag.Get("key"),
+			env:        f.Tag.Get("env"),
+			help:       f.Tag.Get("help"),
+			secret:     f.Tag.Get("secret") == "true",
+			reloadable: f.Tag.Get("reload") == "true",
+			value:      v.Field(i),
+		})
+	}
+	return fields
+}
+
+func (f configField) flagName() string {
+	return strings.Replace(f.key, "_", "-", -1)
+}
+
+func (f configField) set(s string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.Errorf("%s: %q is not an integer", f.key, s)
+		}
+		f.value.SetInt(int64(n))
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.Errorf("%s: %q is not a duration", f.key, s)
+		}
+		f.value.SetInt(int64(d))
+	default:
+		return errors.Errorf("%s: unsupported type %s", f.key, f.value.Type())
+	}
+	return nil
+}
+
+func (f configField) String() string {
+	if !f.value.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+// Set implements flag.Value.
+func (f configField) Set(s string) error {
+	return f.set(s)
+}
+
+// redacted returns the field's value with any secret removed.
+func (f configField) redacted() string {
+	s := f.String()
+	if !f.secret || s == "" {
+		return s
+	}
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" && u.Host != "" {
+		if u.User != nil {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		}
+		return u.String()
+	}
+	return "REDACTED"
+}
+
+// loadConfig builds the configuration from the defaults, the config file,
+// the environment and args, in that order, and validates it. The config
+// file is named by the -config flag or the CONFIG_FILE environment variable.
+func loadConfig(name string, args []string) (*config, []string, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	for _, f := range c.fields() {
+		fs.Var(f, f.flagName(), f.help)
+	}
+	// Flags are parsed twice: first to find the config file, then again on
+	// top of the file and the environment so that they take precedence.
+	probe := flag.NewFlagSet(name, flag.ContinueOnError)
+	probe.SetOutput(ioutil.Discard)
+	probeFile := probe.String("config", *configFile, "")
+	for _, f := range defaultConfig().fields() {
+		probe.Var(f, f.flagName(), "")
+	}
+	probe.Parse(args)
+
+	if *probeFile != "" {
+		if err := c.loadFile(*probeFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return nil, nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+func (c *config) loadEnv() error {
+	for _, f := range c.fields() {
+		if v, ok := os.LookupEnv(f.env); ok && v != "" {
+			if err := f.set(v); err != nil {
+				return errors.Wrap(err, "environment variable "+f.env)
+			}
+		}
+	}
+	return nil
+}
+
+// loadFile reads a flat YAML (`key: value`) or TOML (`key = value`) file,
+// chosen by its extension. Nested tables and lists are not supported as
+// every setting is a scalar.
+func (c *config) loadFile(path string) error {
+	sep := "="
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		sep = ":"
+	case ".toml":
+	default:
+		return errors.Errorf("config file %s: extension must be .yaml, .yml or .toml", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "Opening config file")
+	}
+	defer file.Close()
+
+	fields := make(map[string]configField)
+	for _, f := range c.fields() {
+		fields[f.key] = f
+	}
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		i := strings.Index(line, sep)
+		if i < 0 {
+			return errors.Errorf("%s:%d: expected key %s value", path, n, sep)
+		}
+		key := strings.TrimSpace(line[:i])
+		f, ok := fields[key]
+		if !ok {
+			return errors.Errorf("%s:%d: unknown setting %q", path, n, key)
+		}
+		if err := f.set(parseScalar(line[i+1:])); err != nil {
+			return errors.Wrapf(err, "%s:%d", path, n)
+		}
+	}
+	return errors.Wrap(scanner.Err(), "Reading config file")
+}
+
+// parseScalar unquotes a YAML or TOML scalar, dropping any trailing comment.
+func parseScalar(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
+		if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+			if s[0] == '"' {
+				if u, err := strconv.Unquote(s[:end+2]); err == nil {
+					return u
+				}
+			}
+			return s[1 : end+1]
+		}
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func (c *config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	validPort := func(p string) bool {
+		n, err := strconv.Atoi(p)
+		return err == nil && n > 0 && n < 65536
+	}
+	check(validPort(c.Port), "port: %q is not a valid port", c.Port)
+	check(c.AdminPort == "" || validPort(c.AdminPort), "admin_port: %q is not a valid port", c.AdminPort)
+	check(c.AdminPort == "" || c.AdminPort != c.Port, "admin_port: must differ from port")
+	check(c.AdminPort == "" || c.AdminToken != "", "admin_port: requires admin_token to be set")
+
+	check(c.WidgetSecret == "" || len(c.WidgetSecret) >= 32, "widget_secret: must be at least 32 characters")
+	check(c.InviteSecret == "" || len(c.InviteSecret) >= 32, "invite_secret: must be at least 32 characters")
+
+	u, err := url.Parse(c.RedisURL)
+	check(err == nil && (u.Scheme == "redis" || u.Scheme == "rediss"), "redis_url: must be a redis:// or rediss:// URL")
+
+	_, err = logrus.ParseLevel(c.LogLevel)
+	check(err == nil, "log_level: %q is not a log level", c.LogLevel)
+
+	for _, e := range []string{c.OTLPEndpoint, c.OTLPTracesEndpoint} {
+		if e != "" {
+			u, err := url.Parse(e)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https"), "otlp endpoint: %q is not an http(s) URL", e)
+		}
+	}
+
+	for _, f := range c.fields() {
+		switch v := f.value.Interface().(type) {
+		case int:
+			check(v > 0, "%s: must be positive", f.key)
+		case time.Duration:
+			check(v > 0, "%s: must be positive", f.key)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// logEffective logs every setting, with secrets redacted.
+func (c *config) logEffective() {
+	fields := logrus.Fields{}
+	for _, f := range c.fields() {
+		fields[f.key] = f.redacted()
+	}
+	log.WithFields(fields).Info("Effective configuration")
+}
+
+// writeTOML writes the configuration as a commented TOML file, with secrets
+// redacted if redact is true.
+func (c *config) writeTOML(w io.Writer, redact bool) {
+	for _, f := range c.fields() {
+		v := f.String()
+		if redact {
+			v = f.redacted()
+		}
+		reload := ""
+		if f.reloadable {
+			reload = ", reloadable"
+		}
+		fmt.Fprintf(w, "# %s (env %s, flag -%s%s)\n", f.help, f.env, f.flagName(), reload)
+		switch f.value.Interface().(type) {
+		case int:
+			fmt.Fprintf(w, "%s = %s\n\n", f.key, v)
+		default:
+			fmt.Fprintf(w, "%s = %s\n\n", f.key, strconv.Quote(v))
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// controlChannel carries commands that every instance has to act on, such as
+// disconnecting a session that may live on any of them.
+var controlChannel = redisKey("control")
+
+// redisKey builds a Redis key or channel name in the chat namespace.
+func redisKey(parts ...string) string {
+	return strings.Join(append([]string{Channel}, parts...), ":")
+}
+
+// Control operations.
+const (
+	opDisconnect     = "disconnect"
+	opConfig         = "config"
+	opBansChanged    = "bans_changed"
+	opTenantsChanged = "tenants_changed"
+	opRoomChanged    = "room_changed"
+	opApprove        = "approve"
+	opUpgrade        = "upgrade"
+	opEmojiChanged   = "emoji_changed"
+	opInviteRevoked  = "invite_revoked"
+)
+
+// controlCommand is published on the controlChannel.
+type controlCommand struct {
+	Op string `json:"op"`
+	ID string `json:"id,omitempty"`
+
+	// Tenant is the ID of the tenant the command applies to, empty for the
+	// default tenant.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Settings are configuration changes, keyed by config file key.
+	Settings map[string]string `json:"settings,omitempty"`
+
+	// From is the instance that issued the command.
+	From string `json:"from"`
+}
+
+// publishControl sends cmd to every instance, including this one.
+func publishControl(pool *redis.Pool, cmd controlCommand) error {
+	cmd.From = instance
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return errors.Wrap(err, "Marshaling control command")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PUBLISH", controlChannel, data); err != nil {
+		return errors.Wrap(err, "Unable to publish control command to Redis")
+	}
+	return nil
+}
+
+// handleControl applies a command received on the controlChannel.
+func handleControl(data []byte) {
+	var cmd controlCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		log.WithField("err", err).Error("Error unmarshalling control command")
+		return
+	}
+	l := log.WithFields(logrus.Fields{"op": cmd.Op, "from": cmd.From, "tenant": cmd.Tenant})
+
+	switch cmd.Op {
+	case opDisconnect:
+		l.WithField("conn", cmd.ID).Info("Disconnecting connection")
+		rr.kick(cmd.Tenant, cmd.ID)
+	case opApprove:
+		l.WithField("conn", cmd.ID).Info("Approving connection")
+		rr.approve(cmd.Tenant, cmd.ID)
+	case opUpgrade:
+		l.WithField("conn", cmd.ID).Info("Upgrading guest")
+		rr.upgrade(cmd.Tenant, cmd.ID)
+	case opConfig:
+		if _, err := applySettings(cmd.Settings); err != nil {
+			l.WithField("err", err).Error("Unable to apply configuration")
+		}
+	case opBansChanged:
+		t := tenants.get(cmd.Tenant)
+		if t == nil {
+			l.Warning("Bans changed for an unknown tenant")
+			return
+		}
+		if err := bans.load(rr.pool, t); err != nil {
+			l.WithField("err", err).Error("Unable to reload bans")
+			return
+		}
+		bans.kickBanned(t)
+	case opRoomChanged:
+		t := tenants.get(cmd.Tenant)
+		if t == nil {
+			l.Warning("Room changed for an unknown tenant")
+			return
+		}
+		if err := rooms.load(rr.pool, t); err != nil {
+			l.WithField("err", err).Error("Unable to reload room settings")
+			return
+		}
+		if !rooms.get(t).RequireApproval {
+			rr.approve(t.ID, "")
+		}
+		kickNonMembers(t, "")
+	case opInviteRevoked:
+		t := tenants.get(cmd.Tenant)
+		if t == nil {
+			l.Warning("Invite revoked for an unknown tenant")
+			return
+		}
+		l.WithField("invite", cmd.ID).Info("Invite revoked")
+		kickNonMembers(t, cmd.ID)
+	case opEmojiChanged:
+		t := tenants.get(cmd.Tenant)
+		if t == nil {
+			l.Warning("Emoji changed for an unknown tenant")
+			return
+		}
+		if err := customEmojis.load(rr.pool, t); err != nil {
+			l.WithField("err", err).Error("Unable to reload emoji")
+		}
+	case opTenantsChanged:
+		if err := tenants.load(rr.pool); err != nil {
+			l.WithField("err", err).Error("Unable to reload tenants")
+			return
+		}
+		tenants.kickRemoved()
+		if err := bans.loadAll(rr.pool); err != nil {
+			l.WithField("err", err).Error("Unable to reload bans")
+		}
+		if err := rooms.loadAll(rr.pool); err != nil {
+			l.WithField("err", err).Error("Unable to reload room settings")
+		}
+		if err := customEmojis.loadAll(rr.pool); err != nil {
+			l.WithField("err", err).Error("Unable to reload emoji")
+		}
+	default:
+		l.Warning("Unknown control command")
+	}
+}
+
+// runRegistry periodically records the connections on this instance in Redis,
+// in each tenant's namespace, so that the admin surface of any instance can
+// list the whole cluster. Entries expire after three missed intervals.
+func runRegistry(pool *redis.Pool) {
+	for {
+		if err := writeRegistry(pool, rr.clients()); err != nil {
+			log.WithField("err", err).Error("Unable to update connection registry")
+		}
+		time.Sleep(cfg().RegistryInterval)
+	}
+}
+
+func writeRegistry(pool *redis.Pool, clients []clientInfo) error {
+	byTenant := make(map[string][]clientInfo)
+	for _, c := range clients {
+		byTenant[c.Tenant] = append(byTenant[c.Tenant], c)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	ttl := int(3 * cfg().RegistryInterval / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	conn.Send("MULTI")
+	for _, t := range tenants.all() {
+		infos := byTenant[t.ID]
+		if infos == nil {
+			infos = []clientInfo{}
+		}
+		data, err := json.Marshal(infos)
+		if err != nil {
+			conn.Do("DISCARD")
+			return errors.Wrap(err, "Marshaling connections")
+		}
+		conn.Send("SET", t.key("connections", instance), data, "EX", ttl)
+		conn.Send("SADD", t.key("instances"), instance)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return errors.Wrap(err, "Unable to write connection registry")
+	}
+	return nil
+}
+
+// clusterClients lists the connections of t recorded in Redis by every
+// instance. Instances whose entry has expired are removed from the registry.
+func clusterClients(pool *redis.Pool, t *tenant) ([]clientInfo, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	instances, err := redis.Strings(conn.Do("SMEMBERS", t.key("instances")))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list instances")
+	}
+	clients := make([]clientInfo, 0)
+	for _, name := range instances {
+		data, err := redis.Bytes(conn.Do("GET", t.key("connections", name)))
+		if err == redis.ErrNil {
+			conn.Do("SREM", t.key("instances"), name)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read connection registry")
+		}
+		var infos []clientInfo
+		if err := json.Unmarshal(data, &infos); err != nil {
+			return nil, errors.Wrap(err, "Unmarshaling connection registry")
+		}
+		clients = append(clients, infos...)
+	}
+	return clients, nil
+}
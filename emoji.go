@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	_ "image/gif" // registers the GIF decoder for uploads
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Custom emoji are uploaded by a tenant's admins and stored as PNG images,
+// at most emojiSize pixels wide and high, in the tenant's namespace:
+//
+//   emoji        hash of name to JSON customEmoji
+//   emoji:NAME   PNG image
+//
+// Shortcodes such as :tada: are expanded in chat messages: standard emoji are
+// replaced by their character and custom ones are listed in the message's
+// emoji field with their image URL.
+
+const (
+	emojiSize           = 128
+	maxEmojiUploadBytes = 512 * 1024
+	maxCustomEmoji      = 500
+)
+
+var (
+	validEmojiName = regexp.MustCompile(`^[a-z0-9_+-]{1,32}$`)
+	shortcode      = regexp.MustCompile(`:([a-z0-9_+-]{1,32}):`)
+)
+
+// customEmoji is a custom emoji's metadata. Version changes with the image
+// so that its URL can be cached for good.
+type customEmoji struct {
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (e customEmoji) url() string {
+	return "/emoji/" + e.Name + ".png?v=" + e.Version
+}
+
+// emojiList is this instance's copy of the custom emoji stored in Redis, by
+// tenant.
+type emojiList struct {
+	*tenantCache
+}
+
+var customEmojis = emojiList{newTenantCache(emojiByName)}
+
+func emojiByName(pool *redis.Pool, t *tenant) (interface{}, error) {
+	list, err := listEmoji(pool, t)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]customEmoji, len(list))
+	for _, e := range list {
+		m[e.Name] = e
+	}
+	return m, nil
+}
+
+// get returns the custom emoji of t. The map must not be modified.
+func (l emojiList) get(t *tenant) map[string]customEmoji {
+	m, _ := l.value(t).(map[string]customEmoji)
+	return m
+}
+
+func listEmoji(pool *redis.Pool, t *tenant) ([]customEmoji, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", t.key("emoji")))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list emoji")
+	}
+	list := make([]customEmoji, 0, len(values))
+	for name, data := range values {
+		var e customEmoji
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, errors.Wrapf(err, "Unmarshaling emoji %s", name)
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// saveEmoji validates and resizes an uploaded image and stores it as the
+// custom emoji name of t, replacing any previous image.
+func saveEmoji(pool *redis.Pool, t *tenant, name string, upload []byte) (*customEmoji, error) {
+	if !validEmojiName.MatchString(name) {
+		return nil, errors.Errorf("emoji name %q must be 1 to 32 lower case letters, digits, _, + or -", name)
+	}
+	if _, ok := standardEmoji[name]; ok {
+		return nil, errors.Errorf("emoji name %q is taken by a standard emoji", name)
+	}
+	if len(upload) > maxEmojiUploadBytes {
+		return nil, errors.Errorf("image is larger than %d bytes", maxEmojiUploadBytes)
+	}
+	conf, format, err := image.DecodeConfig(bytes.NewReader(upload))
+	if err != nil {
+		return nil, errors.New("image must be a PNG, JPEG or GIF")
+	}
+	if conf.Width > 4096 || conf.Height > 4096 {
+		return nil, errors.Errorf("%s image of %dx%d pixels is too large", format, conf.Width, conf.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(upload))
+	if err != nil {
+		return nil, errors.Wrap(err, "Decoding image")
+	}
+	img = fitImage(img, emojiSize)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, errors.Wrap(err, "Encoding emoji")
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	e := customEmoji{
+		Name:      name,
+		Version:   hex.EncodeToString(sum[:6]),
+		Width:     img.Bounds().Dx(),
+		Height:    img.Bounds().Dy(),
+		CreatedAt: time.Now(),
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshaling emoji")
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("HLEN", t.key("emoji")))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to count emoji")
+	}
+	if exists, _ := redis.Bool(conn.Do("HEXISTS", t.key("emoji"), name)); !exists && n >= maxCustomEmoji {
+		return nil, errors.Errorf("a tenant can't have more than %d custom emoji", maxCustomEmoji)
+	}
+	if err := t.reserveStorage(conn, "emoji:"+name, buf.Len()+len(data), 0); err != nil {
+		return nil, err
+	}
+	conn.Send("MULTI")
+	conn.Send("SET", t.key("emoji", name), buf.Bytes())
+	conn.Send("HSET", t.key("emoji"), name, data)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, errors.Wrap(err, "Unable to save emoji")
+	}
+	return &e, publishControl(pool, controlCommand{Op: opEmojiChanged, Tenant: t.ID})
+}
+
+// removeEmoji removes the custom emoji name of t.
+func removeEmoji(pool *redis.Pool, t *tenant, name string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("DEL", t.key("emoji", name))
+	conn.Send("HDEL", t.key("emoji"), name)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return errors.Wrap(err, "Unable to remove emoji")
+	}
+	if err := t.releaseStorage(conn, "emoji:"+name); err != nil {
+		return err
+	}
+	return publishControl(pool, controlCommand{Op: opEmojiChanged, Tenant: t.ID})
+}
+
+// fitImage scales img down to fit in a size by size square, keeping its
+// aspect ratio, by averaging the source pixels covered by each pixel.
+func fitImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// expandShortcodes replaces the shortcodes of standard emoji in text by their
+// character and returns the custom emoji of t used in text, by name.
+func expandShortcodes(t *tenant, text string) (string, map[string]string) {
+	custom := customEmojis.get(t)
+	var used map[string]string
+	text = shortcode.ReplaceAllStringFunc(text, func(code string) string {
+		name := code[1 : len(code)-1]
+		if e, ok := standardEmoji[name]; ok {
+			return e
+		}
+		if e, ok := custom[name]; ok {
+			if used == nil {
+				used = make(map[string]string)
+			}
+			used[name] = e.url()
+		}
+		return code
+	})
+	return text, used
+}
+
+// emojiRegistry is served to clients for their emoji pickers.
+type emojiRegistry struct {
+	Standard map[string]string      `json:"standard"`
+	Custom   map[string]emojiRegURL `json:"custom"`
+}
+
+type emojiRegURL struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// handleEmoji serves the emoji registry at /emoji and custom emoji images at
+// /emoji/NAME.png, to the readers readerTenant accepts.
+func handleEmoji(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := readerTenant(w, r)
+	if t == nil {
+		return
+	}
+	if r.URL.Path == "/emoji" {
+		serveEmojiRegistry(w, r, t)
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/emoji/"), ".png")
+	e, ok := customEmojis.get(t)[name]
+	if !ok || !strings.HasSuffix(r.URL.Path, ".png") {
+		http.NotFound(w, r)
+		return
+	}
+	conn := rr.pool.Get()
+	defer conn.Close()
+	img, err := redis.Bytes(conn.Do("GET", t.key("emoji", name)))
+	if err == redis.ErrNil {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.WithField("err", err).Error("Unable to read emoji")
+		http.Error(w, "Unable to read emoji", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", `"`+e.Version+`"`)
+	cache := "public"
+	if readerQuery(r) != nil {
+		cache = "private"
+	}
+	if r.URL.Query().Get("v") == e.Version {
+		w.Header().Set("Cache-Control", cache+", max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", cache+", max-age=300")
+	}
+	http.ServeContent(w, r, "", e.CreatedAt, bytes.NewReader(img))
+}
+
+// serveEmojiRegistry serves the registry of t. Image URLs carry the query
+// parameter that selected t, as images can't send X-Tenant-Token and may
+// not be on the tenant's host.
+func serveEmojiRegistry(w http.ResponseWriter, r *http.Request, t *tenant) {
+	reg := emojiRegistry{Standard: standardEmoji, Custom: make(map[string]emojiRegURL)}
+	query := readerQuery(r)
+	for name, e := range customEmojis.get(t) {
+		u := e.url()
+		if query != nil {
+			u += "&" + query.Encode()
+		}
+		reg.Custom[name] = emojiRegURL{URL: u, Width: e.Width, Height: e.Height}
+	}
+	data, err := json.Marshal(reg)
+	if err != nil {
+		http.Error(w, "Unable to encode emoji registry", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if query != nil {
+		w.Header().Set("Cache-Control", "private, max-age=300")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	w.Header().Add("Vary", "Host, X-Tenant-Token")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// standardEmoji maps the common shortcodes, as used by GitHub and Slack, to
+// their emoji.
+var standardEmoji = map[string]string{
+	"smile": "😄", "smiley": "😃", "grinning": "😀", "grin": "😁", "laughing": "😆", "joy": "😂",
+	"rofl": "🤣", "sweat_smile": "😅", "wink": "😉", "blush": "😊", "innocent": "😇", "slightly_smiling_face": "🙂",
+	"upside_down_face": "🙃", "heart_eyes": "😍", "kissing_heart": "😘", "yum": "😋", "stuck_out_tongue": "😛",
+	"stuck_out_tongue_winking_eye": "😜", "sunglasses": "😎", "nerd_face": "🤓", "thinking": "🤔", "neutral_face": "😐",
+	"expressionless": "😑", "no_mouth": "😶", "smirk": "😏", "unamused": "😒", "roll_eyes": "🙄", "grimacing": "😬",
+	"relieved": "😌", "pensive": "😔", "sleepy": "😪", "sleeping": "😴", "mask": "😷", "face_with_thermometer": "🤒",
+	"nauseated_face": "🤢", "sneezing_face": "🤧", "hot_face": "🥵", "cold_face": "🥶", "dizzy_face": "😵",
+	"exploding_head": "🤯", "cowboy_hat_face": "🤠", "partying_face": "🥳", "confused": "😕", "worried": "😟",
+	"frowning_face": "☹️", "open_mouth": "😮", "hushed": "😯", "astonished": "😲", "flushed": "😳", "pleading_face": "🥺",
+	"cry": "😢", "sob": "😭", "scream": "😱", "disappointed": "😞", "sweat": "😓", "weary": "😩", "tired_face": "😫",
+	"yawning_face": "🥱", "triumph": "😤", "rage": "😡", "angry": "😠", "skull": "💀", "poop": "💩", "clown_face": "🤡",
+	"ghost": "👻", "alien": "👽", "robot": "🤖", "see_no_evil": "🙈", "hear_no_evil": "🙉", "speak_no_evil": "🙊",
+	"wave": "👋", "raised_hand": "✋", "ok_hand": "👌", "v": "✌️", "crossed_fingers": "🤞", "metal": "🤘",
+	"point_left": "👈", "point_right": "👉", "point_up": "☝️", "point_down": "👇", "+1": "👍", "thumbsup": "👍",
+	"-1": "👎", "thumbsdown": "👎", "fist": "✊", "facepunch": "👊", "clap": "👏", "raised_hands": "🙌",
+	"open_hands": "👐", "handshake": "🤝", "pray": "🙏", "muscle": "💪", "eyes": "👀", "brain": "🧠",
+	"heart": "❤️", "orange_heart": "🧡", "yellow_heart": "💛", "green_heart": "💚", "blue_heart": "💙",
+	"purple_heart": "💜", "black_heart": "🖤", "broken_heart": "💔", "sparkling_heart": "💖", "100": "💯",
+	"boom": "💥", "collision": "💥", "sparkles": "✨", "star": "⭐", "star2": "🌟", "dizzy": "💫", "zap": "⚡",
+	"fire": "🔥", "rainbow": "🌈", "sunny": "☀️", "cloud": "☁️", "snowflake": "❄️", "umbrella": "☔", "droplet": "💧",
+	"tada": "🎉", "confetti_ball": "🎊", "balloon": "🎈", "gift": "🎁", "trophy": "🏆", "medal": "🏅", "dart": "🎯",
+	"rocket": "🚀", "airplane": "✈️", "car": "🚗", "ship": "🚢", "construction": "🚧", "rotating_light": "🚨",
+	"coffee": "☕", "tea": "🍵", "beer": "🍺", "beers": "🍻", "wine_glass": "🍷", "pizza": "🍕", "hamburger": "🍔",
+	"cake": "🍰", "birthday": "🎂", "cookie": "🍪", "apple": "🍎", "banana": "🍌", "avocado": "🥑", "taco": "🌮",
+	"dog": "🐶", "cat": "🐱", "mouse": "🐭", "rabbit": "🐰", "fox_face": "🦊", "bear": "🐻", "panda_face": "🐼",
+	"koala": "🐨", "tiger": "🐯", "lion": "🦁", "cow": "🐮", "pig": "🐷", "frog": "🐸", "monkey": "🐒",
+	"chicken": "🐔", "penguin": "🐧", "bird": "🐦", "unicorn": "🦄", "bee": "🐝", "bug": "🐛", "butterfly": "🦋",
+	"snail": "🐌", "turtle": "🐢", "snake": "🐍", "octopus": "🐙", "whale": "🐳", "dolphin": "🐬", "fish": "🐟",
+	"crab": "🦀", "hamster": "🐹", "seedling": "🌱", "evergreen_tree": "🌲", "cactus": "🌵",
+	"four_leaf_clover": "🍀", "rose": "🌹", "sunflower": "🌻", "earth_americas": "🌎", "globe_with_meridians": "🌐",
+	"computer": "💻", "keyboard": "⌨️", "desktop_computer": "🖥️", "iphone": "📱", "phone": "☎️", "email": "📧",
+	"memo": "📝", "pencil2": "✏️", "book": "📖", "books": "📚", "bookmark": "🔖", "link": "🔗", "paperclip": "📎",
+	"pushpin": "📌", "calendar": "📆", "chart_with_upwards_trend": "📈", "chart_with_downwards_trend": "📉",
+	"bar_chart": "📊", "clipboard": "📋", "file_folder": "📁", "package": "📦", "mag": "🔍", "lock": "🔒",
+	"unlock": "🔓", "key": "🔑", "hammer": "🔨", "wrench": "🔧", "gear": "⚙️", "bulb": "💡", "bell": "🔔",
+	"no_bell": "🔕", "loudspeaker": "📢", "mega": "📣", "speech_balloon": "💬", "thought_balloon": "💭",
+	"hourglass": "⌛", "stopwatch": "⏱️", "alarm_clock": "⏰", "moneybag": "💰", "dollar": "💵", "gem": "💎",
+	"white_check_mark": "✅", "heavy_check_mark": "✔️", "ballot_box_with_check": "☑️", "x": "❌",
+	"negative_squared_cross_mark": "❎", "warning": "⚠️", "no_entry": "⛔", "no_entry_sign": "🚫", "question": "❓",
+	"grey_question": "❔", "exclamation": "❗", "bangbang": "‼️", "interrobang": "⁉️", "heavy_plus_sign": "➕",
+	"heavy_minus_sign": "➖", "arrow_up": "⬆️", "arrow_down": "⬇️", "arrow_left": "⬅️", "arrow_right": "➡️",
+	"arrows_counterclockwise": "🔄", "repeat": "🔁", "new": "🆕", "free": "🆓", "up": "🆙", "cool": "🆒", "ok": "🆗",
+	"sos": "🆘", "red_circle": "🔴", "large_blue_circle": "🔵", "white_circle": "⚪", "black_circle": "⚫",
+	"checkered_flag": "🏁", "triangular_flag_on_post": "🚩", "ship_it": "🚢", "shipit": "🚢",
+}
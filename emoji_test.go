@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEmojiImageOfTenantChosenByToken(t *testing.T) {
+	fake, pool := testHub(t)
+	acme := &tenant{ID: "acme", Token: "acme-token"}
+	useTenants(t, acme)
+	useConfig(t, func(c *config) { c.WidgetSecret = "secret" })
+	if _, err := saveEmoji(pool, acme, "acme_logo", testPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := customEmojis.load(pool, acme); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fake.flush()
+		customEmojis.load(pool, acme)
+	})
+	if err := saveSite(pool, &site{Key: "site", Tenant: "acme", Origins: []string{"https://example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	guest, err := signGuestToken(guestClaims{Site: "site", Tenant: "acme", Handle: "guest-1", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleEmoji(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	for _, query := range []string{"?tenant_token=acme-token", "?widget_token=" + guest} {
+		w := get("/emoji" + query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /emoji%s = %d", query, w.Code)
+		}
+		var reg emojiRegistry
+		if err := json.Unmarshal(w.Body.Bytes(), &reg); err != nil {
+			t.Fatal(err)
+		}
+		image := reg.Custom["acme_logo"].URL
+		if image == "" {
+			t.Fatalf("GET /emoji%s lacks acme_logo: %s", query, w.Body)
+		}
+		if w := get(image); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("GET %s = %d %s", image, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+
+	// Without a credential the default tenant has no such emoji.
+	if w := get("/emoji/acme_logo.png"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /emoji/acme_logo.png = %d, want 404", w.Code)
+	}
+	if w := get("/emoji/acme_logo.png?widget_token=forged"); w.Code != http.StatusForbidden {
+		t.Errorf("GET with a forged widget token = %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeRedis is an in-memory Redis server speaking just enough of the protocol
+// for the commands the chat uses, so that tests don't need a Redis server.
+// Keys expire lazily.
+type fakeRedis struct {
+	mu        sync.Mutex
+	strings   map[string]string
+	hashes    map[string]map[string]string
+	sets      map[string]map[string]bool
+	zsets     map[string]map[string]float64
+	expires   map[string]time.Time
+	published []fakeMessage
+	listener  net.Listener
+}
+
+type fakeMessage struct {
+	channel, data string
+}
+
+// startFakeRedis starts a fakeRedis and returns it with a pool connected to
+// it.
+func startFakeRedis() (*fakeRedis, *redis.Pool, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &fakeRedis{listener: l}
+	f.flush()
+	go f.serve()
+	pool := &redis.Pool{
+		MaxIdle: 4,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", l.Addr().String())
+		},
+	}
+	return f, pool, nil
+}
+
+var (
+	hubOnce  sync.Once
+	hubRedis *fakeRedis
+	hubPool  *redis.Pool
+)
+
+// testHub returns an emptied fakeRedis and a pool connected to it, with rr
+// and rw using that pool and running. The hub goroutines read the globals
+// for as long as the test binary runs, so they are only set once.
+func testHub(t *testing.T) (*fakeRedis, *redis.Pool) {
+	hubOnce.Do(func() {
+		var err error
+		if hubRedis, hubPool, err = startFakeRedis(); err != nil {
+			t.Fatal(err)
+		}
+		rr = newRedisReceiver(hubPool)
+		go rr.connHandler()
+		rw = newRedisWriter(hubPool)
+		go rw.run()
+	})
+	if hubPool == nil {
+		t.Fatal("test hub failed to start")
+	}
+	hubRedis.flush()
+	return hubRedis, hubPool
+}
+
+func (f *fakeRedis) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.strings = make(map[string]string)
+	f.hashes = make(map[string]map[string]string)
+	f.sets = make(map[string]map[string]bool)
+	f.zsets = make(map[string]map[string]float64)
+	f.expires = make(map[string]time.Time)
+	f.published = nil
+}
+
+// keys returns every live key, sorted.
+func (f *fakeRedis) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.keysLocked()
+}
+
+func (f *fakeRedis) keysLocked() []string {
+	seen := make(map[string]bool)
+	for k := range f.strings {
+		seen[k] = true
+	}
+	for k := range f.hashes {
+		seen[k] = true
+	}
+	for k := range f.sets {
+		seen[k] = true
+	}
+	for k := range f.zsets {
+		seen[k] = true
+	}
+	var keys []string
+	for k := range seen {
+		if !f.expiredLocked(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeRedis) expiredLocked(key string) bool {
+	at, ok := f.expires[key]
+	if !ok || time.Now().Before(at) {
+		return false
+	}
+	f.delLocked(key)
+	return true
+}
+
+func (f *fakeRedis) delLocked(key string) bool {
+	_, s := f.strings[key]
+	_, h := f.hashes[key]
+	_, st := f.sets[key]
+	_, z := f.zsets[key]
+	delete(f.strings, key)
+	delete(f.hashes, key)
+	delete(f.sets, key)
+	delete(f.zsets, key)
+	delete(f.expires, key)
+	return s || h || st || z
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		c, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(c)
+	}
+}
+
+func (f *fakeRedis) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		switch {
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			writeReply(w, "+OK")
+		case name == "DISCARD":
+			inMulti, queued = false, nil
+			writeReply(w, "+OK")
+		case name == "EXEC":
+			replies := make([]interface{}, len(queued))
+			f.mu.Lock()
+			for i, q := range queued {
+				replies[i] = f.execLocked(q)
+			}
+			f.mu.Unlock()
+			inMulti, queued = false, nil
+			writeReply(w, replies)
+		case inMulti:
+			queued = append(queued, args)
+			writeReply(w, "+QUEUED")
+		default:
+			f.mu.Lock()
+			reply := f.execLocked(args)
+			f.mu.Unlock()
+			writeReply(w, reply)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// writeReply writes v: strings starting with + or - are status and error
+// replies, other strings bulk strings, nil a null bulk string.
+func writeReply(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		if strings.HasPrefix(v, "+") || strings.HasPrefix(v, "-") {
+			w.WriteString(v + "\r\n")
+		} else {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+		}
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, s := range v {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
+
+func formatScore(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (f *fakeRedis) execLocked(args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	if len(args) > 1 {
+		f.expiredLocked(args[1])
+	}
+	switch name {
+	case "PING":
+		return "+PONG"
+	case "PUBLISH":
+		f.published = append(f.published, fakeMessage{args[1], args[2]})
+		return 0
+	case "GET":
+		if v, ok := f.strings[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		key := args[1]
+		var ttl time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if _, ok := f.strings[key]; ok {
+					return nil
+				}
+			case "EX":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(n) * time.Second
+				i++
+			case "PX":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(n) * time.Millisecond
+				i++
+			}
+		}
+		f.delLocked(key)
+		f.strings[key] = args[2]
+		if ttl > 0 {
+			f.expires[key] = time.Now().Add(ttl)
+		}
+		return "+OK"
+	case "INCR":
+		n, _ := strconv.Atoi(f.strings[args[1]])
+		n++
+		f.strings[args[1]] = strconv.Itoa(n)
+		return n
+	case "EXPIRE":
+		n, _ := strconv.Atoi(args[2])
+		f.expires[args[1]] = time.Now().Add(time.Duration(n) * time.Second)
+		return 1
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			f.expiredLocked(k)
+			if f.delLocked(k) {
+				n++
+			}
+		}
+		return n
+	case "SCAN":
+		var keys []string
+		pattern := "*"
+		for i := 2; i < len(args)-1; i++ {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		for _, k := range f.keysLocked() {
+			if ok, _ := path.Match(pattern, k); ok {
+				keys = append(keys, k)
+			}
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+		return []interface{}{"0", keys}
+	case "HGET":
+		if v, ok := f.hashes[args[1]][args[2]]; ok {
+			return v
+		}
+		return nil
+	case "HMGET":
+		replies := make([]interface{}, 0, len(args)-2)
+		for _, field := range args[2:] {
+			if v, ok := f.hashes[args[1]][field]; ok {
+				replies = append(replies, v)
+			} else {
+				replies = append(replies, nil)
+			}
+		}
+		return replies
+	case "HSET", "HSETNX":
+		h := f.hashes[args[1]]
+		if h == nil {
+			h = make(map[string]string)
+			f.hashes[args[1]] = h
+		}
+		added := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; ok {
+				if name == "HSETNX" {
+					return 0
+				}
+			} else {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return added
+	case "HDEL":
+		n := 0
+		for _, field := range args[2:] {
+			if _, ok := f.hashes[args[1]][field]; ok {
+				delete(f.hashes[args[1]], field)
+				n++
+			}
+		}
+		if len(f.hashes[args[1]]) == 0 {
+			delete(f.hashes, args[1])
+		}
+		return n
+	case "HGETALL":
+		var out []string
+		for k, v := range f.hashes[args[1]] {
+			out = append(out, k, v)
+		}
+		if out == nil {
+			out = []string{}
+		}
+		return out
+	case "HKEYS":
+		out := []string{}
+		for k := range f.hashes[args[1]] {
+			out = append(out, k)
+		}
+		return out
+	case "HLEN":
+		return len(f.hashes[args[1]])
+	case "HEXISTS":
+		if _, ok := f.hashes[args[1]][args[2]]; ok {
+			return 1
+		}
+		return 0
+	case "SADD":
+		s := f.sets[args[1]]
+		if s == nil {
+			s = make(map[string]bool)
+			f.sets[args[1]] = s
+		}
+		n := 0
+		for _, m := range args[2:] {
+			if !s[m] {
+				s[m] = true
+				n++
+			}
+		}
+		return n
+	case "SREM":
+		n := 0
+		for _, m := range args[2:] {
+			if f.sets[args[1]][m] {
+				delete(f.sets[args[1]], m)
+				n++
+			}
+		}
+		if len(f.sets[args[1]]) == 0 {
+			delete(f.sets, args[1])
+		}
+		return n
+	case "SMEMBERS":
+		out := []string{}
+		for m := range f.sets[args[1]] {
+			out = append(out, m)
+		}
+		return out
+	case "SCARD":
+		return len(f.sets[args[1]])
+	case "SISMEMBER":
+		if f.sets[args[1]][args[2]] {
+			return 1
+		}
+		return 0
+	case "ZADD":
+		z := f.zsets[args[1]]
+		xx, incr := false, false
+		i := 2
+	flags:
+		for ; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "XX":
+				xx = true
+			case "INCR":
+				incr = true
+			default:
+				break flags
+			}
+		}
+		if z == nil {
+			if xx {
+				return nil
+			}
+			z = make(map[string]float64)
+			f.zsets[args[1]] = z
+		}
+		added := 0
+		for ; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			member := args[i+1]
+			old, exists := z[member]
+			if xx && !exists {
+				if incr {
+					return nil
+				}
+				continue
+			}
+			if incr {
+				score += old
+			}
+			if !exists {
+				added++
+			}
+			z[member] = score
+			if incr {
+				return formatScore(score)
+			}
+		}
+		return added
+	case "ZSCORE":
+		if s, ok := f.zsets[args[1]][args[2]]; ok {
+			return formatScore(s)
+		}
+		return nil
+	case "ZREM":
+		n := 0
+		for _, m := range args[2:] {
+			if _, ok := f.zsets[args[1]][m]; ok {
+				delete(f.zsets[args[1]], m)
+				n++
+			}
+		}
+		return n
+	case "ZREVRANGE":
+		type entry struct {
+			member string
+			score  float64
+		}
+		var entries []entry
+		for m, s := range f.zsets[args[1]] {
+			entries = append(entries, entry{m, s})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].score != entries[j].score {
+				return entries[i].score > entries[j].score
+			}
+			return entries[i].member > entries[j].member
+		})
+		start, _ := strconv.Atoi(args[2])
+		stop, _ := strconv.Atoi(args[3])
+		if stop < 0 || stop >= len(entries) {
+			stop = len(entries) - 1
+		}
+		withScores := len(args) > 4 && strings.ToUpper(args[4]) == "WITHSCORES"
+		out := []string{}
+		for i := start; i <= stop && i < len(entries); i++ {
+			out = append(out, entries[i].member)
+			if withScores {
+				out = append(out, formatScore(entries[i].score))
+			}
+		}
+		return out
+	}
+	return "-ERR unknown command '" + args[0] + "'"
+}
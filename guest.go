@@ -0,0 +1,65 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Widget visitors join as guests: they get a handle issued by the server and
+// a session that ends when their token expires. Until an administrator
+// upgrades them to full members they are held to tighter limits than other
+// connections.
+
+// linkPattern matches the links guests are not allowed to post, with or
+// without a scheme.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|co|me|info|biz|ru|cn|xyz|top|ly|gl)\b`)
+
+// containsLink returns true if text contains something that looks like a
+// link.
+func containsLink(text string) bool {
+	return linkPattern.MatchString(text)
+}
+
+// allowGuestMessage counts a message of the guest with the provided handle
+// against the per guest rate limit, shared by every instance, and returns
+// false if it has been used up.
+func allowGuestMessage(pool *redis.Pool, t *tenant, handle string) (bool, error) {
+	window := strconv.FormatInt(time.Now().Unix()/60, 10)
+	n, err := countInWindow(pool, t.key("guest-rate", handle, window), 2*time.Minute)
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to count guest message")
+	}
+	return n <= cfg().GuestMessagesPerMinute, nil
+}
+
+// allowGuestToken counts a guest token issued to the provided address for a
+// site of t against the per address limit, and returns false if it has been
+// used up. Without it a guest could get a new handle, and with it a fresh
+// message limit and Q&A vote, for every message.
+func allowGuestToken(pool *redis.Pool, t *tenant, site, addr string) (bool, error) {
+	window := strconv.FormatInt(time.Now().Unix()/3600, 10)
+	n, err := countInWindow(pool, t.key("guest-tokens", site, addr, window), 2*time.Hour)
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to count guest token")
+	}
+	return n <= cfg().GuestTokensPerHour, nil
+}
+
+// countInWindow increments the counter at key, which expires after ttl, and
+// returns its new value.
+func countInWindow(pool *redis.Pool, key string, ttl time.Duration) (int, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("INCR", key)
+	conn.Send("EXPIRE", key, int(ttl/time.Second))
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(replies[0], nil)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useConfig applies change to a copy of the configuration in effect for the
+// duration of the test.
+func useConfig(t *testing.T, change func(c *config)) {
+	saved := cfg()
+	c := *saved
+	change(&c)
+	currentConfig.Store(&c)
+	t.Cleanup(func() { currentConfig.Store(saved) })
+}
+
+func TestGuestTokenLimit(t *testing.T) {
+	_, pool := testHub(t)
+	useTenants(t)
+	useConfig(t, func(c *config) {
+		c.WidgetSecret = "secret"
+		c.GuestTokensPerHour = 2
+	})
+	if err := saveSite(pool, &site{Key: "site", Origins: []string{"https://example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	h := &widgetHandler{pool: pool}
+	issue := func(addr string) int {
+		r := httptest.NewRequest("POST", "/widget/token?key=site", nil)
+		r.Header.Set("Origin", "https://example.com")
+		r.Header.Set("X-Forwarded-For", addr)
+		w := httptest.NewRecorder()
+		h.handleToken(w, r)
+		return w.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := issue("192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("token %d = %d", i, code)
+		}
+	}
+	if code := issue("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("token over the limit = %d", code)
+	}
+	if code := issue("192.0.2.2"); code != http.StatusOK {
+		t.Errorf("token for another address = %d", code)
+	}
+}
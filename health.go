@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	startedAt = time.Now()
+	draining  drainState
+)
+
+// loopState tracks whether one of the Redis loops is currently connected.
+type loopState struct {
+	mu        sync.Mutex
+	connected bool
+	since     time.Time
+	lastErr   error
+}
+
+func newLoopState() *loopState {
+	return &loopState{since: time.Now()}
+}
+
+// set records a change in connection state. err is the reason for a
+// disconnect and is ignored when connected is true.
+func (s *loopState) set(connected bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connected != connected {
+		s.since = time.Now()
+	}
+	s.connected = connected
+	if err != nil {
+		s.lastErr = err
+	}
+}
+
+// loopStatus is a point in time copy of a loopState.
+type loopStatus struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (s *loopState) status() loopStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := loopStatus{Connected: s.connected, Since: s.since}
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+	return st
+}
+
+// disconnectedFor returns how long the loop has been disconnected, or zero if
+// it is connected.
+func (st loopStatus) disconnectedFor() time.Duration {
+	if st.Connected {
+		return 0
+	}
+	return time.Since(st.Since)
+}
+
+// drainState is set once the process has been asked to shut down.
+type drainState struct {
+	mu    sync.Mutex
+	since time.Time
+}
+
+func (d *drainState) start() {
+	d.mu.Lock()
+	if d.since.IsZero() {
+		d.since = time.Now()
+	}
+	d.mu.Unlock()
+}
+
+func (d *drainState) active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.since.IsZero()
+}
+
+// queueStatus describes the depth of a buffered channel.
+type queueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+func (q queueStatus) full() bool {
+	return q.Capacity > 0 && q.Depth >= q.Capacity
+}
+
+// hubStatus is the result of probing the connection hub loop.
+type hubStatus struct {
+	Responsive  bool   `json:"responsive"`
+	Latency     string `json:"latency"`
+	Connections int    `json:"connections"`
+}
+
+func probeHub() hubStatus {
+	start := time.Now()
+	conns, ok := rr.probe(cfg().HubProbeTimeout)
+	return hubStatus{
+		Responsive:  ok,
+		Latency:     time.Since(start).String(),
+		Connections: conns,
+	}
+}
+
+// readiness is the body returned by /readyz.
+type readiness struct {
+	Ready    bool        `json:"ready"`
+	Reasons  []string    `json:"reasons,omitempty"`
+	Draining bool        `json:"draining"`
+	Receiver loopStatus  `json:"redis_receiver"`
+	Writer   loopStatus  `json:"redis_writer"`
+	Outbox   queueStatus `json:"outbox"`
+	Hub      hubStatus   `json:"hub"`
+}
+
+func checkReadiness() readiness {
+	r := readiness{
+		Draining: draining.active(),
+		Receiver: rr.state.status(),
+		Writer:   rw.state.status(),
+		Outbox:   queueStatus{Depth: len(rw.messages), Capacity: cap(rw.messages)},
+		Hub:      probeHub(),
+	}
+	if r.Draining {
+		r.Reasons = append(r.Reasons, "draining")
+	}
+	threshold := cfg().ReadyDisconnectThreshold
+	if d := r.Receiver.disconnectedFor(); d > threshold {
+		r.Reasons = append(r.Reasons, "redis receiver disconnected for "+d.Round(time.Second).String())
+	}
+	if d := r.Writer.disconnectedFor(); d > threshold {
+		r.Reasons = append(r.Reasons, "redis writer disconnected for "+d.Round(time.Second).String())
+	}
+	if r.Outbox.full() {
+		r.Reasons = append(r.Reasons, "outbox full")
+	}
+	if !r.Hub.Responsive {
+		r.Reasons = append(r.Reasons, "hub loop unresponsive")
+	}
+	r.Ready = len(r.Reasons) == 0
+	return r
+}
+
+// status is the body returned by /debug/status and /admin/api/status.
+type status struct {
+	readiness
+	Instance   string      `json:"instance"`
+	StartedAt  time.Time   `json:"started_at"`
+	Uptime     string      `json:"uptime"`
+	GoVersion  string      `json:"go_version"`
+	Goroutines int         `json:"goroutines"`
+	HeapAlloc  uint64      `json:"heap_alloc_bytes"`
+	Broadcasts queueStatus `json:"broadcast_queue"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.WithField("err", err).Error("Error writing JSON response")
+	}
+}
+
+// handleHealthz reports that the process is alive and serving HTTP.
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether this instance should receive traffic.
+func handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	r := checkReadiness()
+	code := http.StatusOK
+	if !r.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, r)
+}
+
+// writeStatus writes a detailed snapshot of the instance's state. It tells
+// more than the probes need, so it is only served behind the admin token.
+func writeStatus(w http.ResponseWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeJSON(w, http.StatusOK, status{
+		readiness:  checkReadiness(),
+		Instance:   instance,
+		StartedAt:  startedAt,
+		Uptime:     time.Since(startedAt).Round(time.Second).String(),
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		Broadcasts: queueStatus{Depth: len(rr.messages), Capacity: cap(rr.messages)},
+	})
+}
+
+// handleSignals drains the instance on SIGTERM or SIGINT: readiness starts
+// failing, new websocket connections are refused, and the process exits once
+// the writer queue has been flushed to Redis or the drain timeout has passed,
+// and the transcripts have been written.
+func handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+
+	drainTimeout := cfg().DrainTimeout
+	l := log.WithFields(logrus.Fields{"signal": sig, "drainTimeout": drainTimeout})
+	l.Info("Draining")
+	draining.start()
+
+	deadline := time.Now().Add(drainTimeout)
+	for len(rw.messages) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if transcripts != nil {
+		transcripts.close()
+	}
+	l.WithField("outbox", len(rw.messages)).Info("Drained, exiting")
+	os.Exit(0)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// lexer describes just enough of a language's syntax to highlight it:
+// keywords, comments, strings and numbers. Highlighted code uses the short
+// class names of Pygments and chroma (k, s, c, m) so that their stylesheets
+// apply.
+type lexer struct {
+	keywords     map[string]bool
+	lineComments []string
+	blockComment [2]string
+	quotes       string // characters delimiting strings
+	rawQuote     byte   // delimits strings that may span lines, if any
+}
+
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var cKeywords = "auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while bool true false NULL"
+
+var lexers = map[string]*lexer{
+	"go": {
+		keywords:     words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		rawQuote:     '`',
+	},
+	"python": {
+		keywords:     words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self"),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+	},
+	"javascript": {
+		keywords:     words("async await break case catch class const continue debugger default delete do else export extends finally for function if import in instanceof let new of return super switch this throw try typeof var void while with yield null undefined true false interface type enum implements"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		rawQuote:     '`',
+	},
+	"java": {
+		keywords:     words("abstract assert boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long native new package private protected public return short static super switch synchronized this throw throws try void volatile while null true false var"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	},
+	"c": {
+		keywords:     words(cKeywords),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	},
+	"cpp": {
+		keywords:     words(cKeywords + " class namespace template typename public private protected virtual override new delete this using try catch throw nullptr auto constexpr"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	},
+	"rust": {
+		keywords:     words("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"`,
+	},
+	"ruby": {
+		keywords:     words("alias and begin break case class def defined? do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield require"),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+	},
+	"shell": {
+		keywords:     words("if then else elif fi case esac for while until do done in function return export local echo exit set unset"),
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+	},
+	"sql": {
+		keywords:     words("select from where and or not insert into values update set delete create table index drop alter join left right inner outer on group by order having limit offset as distinct null is in like union all primary key references default SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE INDEX DROP ALTER JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT OFFSET AS DISTINCT NULL IS IN LIKE UNION ALL PRIMARY KEY REFERENCES DEFAULT"),
+		lineComments: []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `'"`,
+	},
+	"json": {
+		keywords: words("true false null"),
+		quotes:   `"`,
+	},
+	"text": {},
+}
+
+// languageAliases maps the language hints clients may send to the lexers.
+var languageAliases = map[string]string{
+	"golang": "go",
+	"py":     "python", "python3": "python",
+	"js": "javascript", "ts": "javascript", "typescript": "javascript", "node": "javascript",
+	"h": "c", "c++": "cpp", "cc": "cpp", "hpp": "cpp",
+	"rs": "rust",
+	"rb": "ruby",
+	"sh": "shell", "bash": "shell", "zsh": "shell", "console": "shell",
+	"plain": "text", "txt": "text", "plaintext": "text",
+}
+
+// languageExtensions are the file extensions of downloaded snippets.
+var languageExtensions = map[string]string{
+	"go": "go", "python": "py", "javascript": "js", "java": "java", "c": "c", "cpp": "cpp",
+	"rust": "rs", "ruby": "rb", "shell": "sh", "sql": "sql", "json": "json", "text": "txt",
+}
+
+// normalizeLanguage returns the lexer name for a language hint, or an empty
+// string if the hint is unknown.
+func normalizeLanguage(hint string) string {
+	hint = strings.ToLower(strings.TrimSpace(hint))
+	if alias, ok := languageAliases[hint]; ok {
+		return alias
+	}
+	if _, ok := lexers[hint]; ok {
+		return hint
+	}
+	return ""
+}
+
+// languageHints are checked in order by detectLanguage. Stack traces are
+// recognized as the language that printed them.
+var languageHints = []struct {
+	language string
+	pattern  *regexp.Regexp
+}{
+	{"shell", regexp.MustCompile(`\A#!\s*/\S*(?:sh|bash|zsh)\b`)},
+	{"python", regexp.MustCompile(`\A#!\s*/\S*python|Traceback \(most recent call last\)|(?m)^\s*(?:def|class) \w+.*:\s*$|(?m)^\s*from [\w.]+ import `)},
+	{"go", regexp.MustCompile(`(?m)^package \w+\s*$|(?m)^goroutine \d+ \[|(?m)^func (?:\(\w+ \*?\w+\) )?\w+\(|:= `)},
+	{"java", regexp.MustCompile(`(?m)^\s+at [\w$.]+\([\w$]+\.java:\d+\)|Exception in thread "|(?m)^\s*public (?:static )?(?:class|void|final) `)},
+	{"rust", regexp.MustCompile(`(?m)^\s*(?:pub )?fn \w+|(?m)^\s*let mut |(?m)^\s*use \w+::`)},
+	{"cpp", regexp.MustCompile(`(?m)^#include <(?:iostream|vector|string|map)>|std::|(?m)^\s*template\s*<`)},
+	{"c", regexp.MustCompile(`(?m)^#include [<"]|(?m)^int main\(`)},
+	{"javascript", regexp.MustCompile(`(?m)^\s+at .+ \(.+\.js:\d+:\d+\)|\bfunction\s*\w*\s*\(|=>|\bconst \w+ = |\bconsole\.log\(|\brequire\(['"]`)},
+	{"ruby", regexp.MustCompile(`(?m)^\s*(?:def \w+|end)\s*$|(?m)^\s*require ['"]|\.each do \|`)},
+	{"sql", regexp.MustCompile(`(?i)^\s*(?:select\s.+\sfrom\s|insert\s+into\s|update\s+\w+\s+set\s|create\s+table\s|delete\s+from\s)`)},
+	{"shell", regexp.MustCompile(`(?m)^\$ \w+|(?m)^\s*(?:sudo|apt-get|npm|go|git|docker|kubectl|curl) [\w-]`)},
+}
+
+// detectLanguage guesses the language of code, falling back to text.
+func detectLanguage(code string) string {
+	trimmed := strings.TrimSpace(code)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+	for _, h := range languageHints {
+		if h.pattern.MatchString(code) {
+			return h.language
+		}
+	}
+	return "text"
+}
+
+func isIdentStart(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+func isIdent(b byte) bool {
+	return isIdentStart(b) || b >= '0' && b <= '9'
+}
+
+// highlight renders code as HTML, wrapping tokens of language in spans. The
+// result is only the highlighted text; callers put it in a pre element.
+func highlight(code, language string) string {
+	lx := lexers[language]
+	if lx == nil {
+		lx = lexers["text"]
+	}
+	var buf bytes.Buffer
+	span := func(class, text string) {
+		buf.WriteString(`<span class="` + class + `">`)
+		buf.WriteString(html.EscapeString(text))
+		buf.WriteString("</span>")
+	}
+	plain := 0 // start of the pending plain text
+	flush := func(i int) {
+		buf.WriteString(html.EscapeString(code[plain:i]))
+	}
+
+	for i := 0; i < len(code); {
+		start := i
+		class := ""
+		switch {
+		case lx.blockComment[0] != "" && strings.HasPrefix(code[i:], lx.blockComment[0]):
+			end := strings.Index(code[i+len(lx.blockComment[0]):], lx.blockComment[1])
+			if end < 0 {
+				i = len(code)
+			} else {
+				i += len(lx.blockComment[0]) + end + len(lx.blockComment[1])
+			}
+			class = "c"
+		case hasAnyPrefix(code[i:], lx.lineComments):
+			if end := strings.IndexByte(code[i:], '\n'); end < 0 {
+				i = len(code)
+			} else {
+				i += end
+			}
+			class = "c"
+		case lx.rawQuote != 0 && code[i] == lx.rawQuote:
+			if end := strings.IndexByte(code[i+1:], lx.rawQuote); end < 0 {
+				i = len(code)
+			} else {
+				i += end + 2
+			}
+			class = "s"
+		case strings.IndexByte(lx.quotes, code[i]) >= 0:
+			quote := code[i]
+			for i++; i < len(code) && code[i] != quote && code[i] != '\n'; i++ {
+				if code[i] == '\\' {
+					i++
+				}
+			}
+			if i < len(code) && code[i] == quote {
+				i++
+			}
+			if i > len(code) {
+				i = len(code)
+			}
+			class = "s"
+		case code[i] >= '0' && code[i] <= '9' && (i == 0 || !isIdent(code[i-1])):
+			for i++; i < len(code) && (isIdent(code[i]) || code[i] == '.'); i++ {
+			}
+			class = "m"
+		case isIdentStart(code[i]) && (i == 0 || !isIdent(code[i-1])):
+			for i++; i < len(code) && isIdent(code[i]); i++ {
+			}
+			if lx.keywords[code[start:i]] {
+				class = "k"
+			}
+		default:
+			i++
+		}
+		if class != "" {
+			flush(start)
+			span(class, code[start:i])
+			plain = i
+		}
+	}
+	flush(len(code))
+	return buf.String()
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Private rooms only admit members, who join with an invite link made by an
+// administrator of the tenant: the chat page with ?invite=TOKEN. The token is
+// signed with the invite secret and names an invite stored at the tenant's
+// "invites" key, which holds its usage limit and is removed when revoked.
+//
+// As connections are anonymous, members are told apart by their address,
+// like voters. Joining from a new address uses the invite once, within its
+// expiry and usage limit. Reconnecting from an address that has joined
+// doesn't, and keeps working after the invite has expired. Revoking the
+// invite ends the membership of every address that joined with it.
+
+// invite is an invite link to the private room of a tenant.
+type invite struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"`
+	MaxUses   int       `json:"max_uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Uses is the number of addresses that have joined with the invite and
+	// Pending is true while it can still be used. They are filled in when
+	// listing.
+	Uses    int  `json:"uses"`
+	Pending bool `json:"pending"`
+}
+
+// inviteClaims are signed into the token of an invite.
+type inviteClaims struct {
+	Tenant  string `json:"tenant,omitempty"`
+	Invite  string `json:"invite"`
+	MaxUses int    `json:"max_uses"`
+	Expires int64  `json:"exp"`
+}
+
+// createInvite creates an invite to t's room that maxUses addresses can join
+// with until ttl has passed.
+func createInvite(pool *redis.Pool, t *tenant, maxUses int, ttl time.Duration) (*invite, error) {
+	if cfg().InviteSecret == "" {
+		return nil, errors.New("invites are disabled")
+	}
+	now := time.Now().UTC()
+	inv := invite{
+		ID:        newID(),
+		MaxUses:   maxUses,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	token, err := signClaims(cfg().InviteSecret, inviteClaims{
+		Tenant:  t.ID,
+		Invite:  inv.ID,
+		MaxUses: maxUses,
+		Expires: inv.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	inv.Token = token
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshaling invite")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", t.key("invites"), inv.ID, data); err != nil {
+		return nil, errors.Wrap(err, "Unable to save invite")
+	}
+	inv.Pending = true
+	return &inv, nil
+}
+
+// listInvites returns the invites to t's room, oldest first.
+func listInvites(pool *redis.Pool, t *tenant) ([]invite, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", t.key("invites")))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list invites")
+	}
+	list := make([]invite, 0, len(values))
+	for id, data := range values {
+		var inv invite
+		if err := json.Unmarshal([]byte(data), &inv); err != nil {
+			return nil, errors.Wrapf(err, "Unmarshaling invite %s", id)
+		}
+		if inv.Uses, err = redis.Int(conn.Do("SCARD", t.key("invite-members", id))); err != nil {
+			return nil, errors.Wrap(err, "Unable to count invite uses")
+		}
+		inv.Pending = inv.Uses < inv.MaxUses && time.Now().Before(inv.ExpiresAt)
+		list = append(list, inv)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+// revokeInvite removes an invite to t's room across the cluster, ending the
+// membership of those who joined with it. It returns false if there is no
+// such invite.
+func revokeInvite(pool *redis.Pool, t *tenant, id string) (bool, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("HDEL", t.key("invites"), id))
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to revoke invite")
+	}
+	if n == 0 {
+		return false, nil
+	}
+	if _, err := conn.Do("DEL", t.key("invite-members", id)); err != nil {
+		return false, errors.Wrap(err, "Unable to revoke invite")
+	}
+	return true, publishControl(pool, controlCommand{Op: opInviteRevoked, Tenant: t.ID, ID: id})
+}
+
+// openInvite verifies an invite token and returns the tenant it invites to
+// and its claims. The invite must not have been revoked.
+func openInvite(pool *redis.Pool, token string) (*tenant, inviteClaims, error) {
+	var claims inviteClaims
+	if cfg().InviteSecret == "" {
+		return nil, claims, errors.New("invites are disabled")
+	}
+	if err := verifyClaims(cfg().InviteSecret, token, &claims); err != nil {
+		return nil, claims, errors.Wrap(err, "Invite token")
+	}
+	t := tenants.get(claims.Tenant)
+	if t == nil {
+		return nil, claims, errors.New("tenant no longer exists")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	exists, err := redis.Bool(conn.Do("HEXISTS", t.key("invites"), claims.Invite))
+	if err != nil {
+		return nil, claims, errors.Wrap(err, "Unable to read invite")
+	}
+	if !exists {
+		return nil, claims, errors.New("invite has been revoked")
+	}
+	return t, claims, nil
+}
+
+// joinInvite admits addr to the room of the tenant the invite token invites
+// to, using the invite if addr hasn't joined with it before. It returns the
+// tenant and the ID of the invite.
+func joinInvite(pool *redis.Pool, token, addr string) (*tenant, string, error) {
+	t, claims, err := openInvite(pool, token)
+	if err != nil {
+		return nil, "", err
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	members := t.key("invite-members", claims.Invite)
+	added, err := redis.Int(conn.Do("SADD", members, addr))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Unable to use invite")
+	}
+	if added == 0 {
+		return t, claims.Invite, nil
+	}
+	var reason string
+	if time.Now().Unix() > claims.Expires {
+		reason = "invite has expired"
+	} else if n, err := redis.Int(conn.Do("SCARD", members)); err != nil {
+		reason = "unable to count invite uses"
+	} else if n > claims.MaxUses {
+		reason = "invite has been used up"
+	}
+	if reason != "" {
+		conn.Do("SREM", members, addr)
+		return nil, "", errors.New(reason)
+	}
+	return t, claims.Invite, nil
+}
+
+// inviteMember returns the tenant the invite token invites to if addr has
+// joined its room with it, without using the invite.
+func inviteMember(pool *redis.Pool, token, addr string) (*tenant, error) {
+	t, claims, err := openInvite(pool, token)
+	if err != nil {
+		return nil, err
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	member, err := redis.Bool(conn.Do("SISMEMBER", t.key("invite-members", claims.Invite), addr))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to check invite")
+	}
+	if !member {
+		return nil, errors.New("not a member")
+	}
+	return t, nil
+}
+
+// kickNonMembers disconnects the connections of t on this instance that
+// aren't members of its room, if it is private: those that didn't join with
+// an invite and those that joined with the revoked one.
+func kickNonMembers(t *tenant, revoked string) {
+	if !rooms.get(t).Private {
+		return
+	}
+	for _, c := range rr.clients() {
+		if c.Tenant == t.ID && (c.Invite == "" || c.Invite == revoked) {
+			rr.kick(t.ID, c.ID)
+		}
+	}
+}
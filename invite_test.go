@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPrivateRoomInvite(t *testing.T) {
+	fake, pool := testHub(t)
+	acme := &tenant{ID: "acme", Token: "acme-token"}
+	useTenants(t, acme)
+	useConfig(t, func(c *config) { c.InviteSecret = strings.Repeat("s", 32) })
+	if err := saveRoom(pool, acme, roomSettings{Private: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rooms.load(pool, acme); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fake.flush()
+		rooms.load(pool, acme)
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	defer server.Close()
+	// dial connects from the provided address, returning the status of a
+	// rejected connection.
+	dial := func(query, addr string) (*websocket.Conn, int) {
+		ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+query, http.Header{"X-Forwarded-For": {addr}})
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp.StatusCode
+		}
+		return ws, http.StatusSwitchingProtocols
+	}
+
+	if _, code := dial("?tenant_token=acme-token", "192.0.2.1"); code != http.StatusForbidden {
+		t.Errorf("joining without an invite = %d, want 403", code)
+	}
+
+	inv, err := createInvite(pool, acme, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, code := dial("?invite="+inv.Token, "192.0.2.1")
+	if ws == nil {
+		t.Fatalf("joining with an invite = %d", code)
+	}
+	defer ws.Close()
+	// Reconnecting doesn't use the invite again, another address does.
+	again, code := dial("?invite="+inv.Token, "192.0.2.1")
+	if again == nil {
+		t.Fatalf("reconnecting with an invite = %d", code)
+	}
+	again.Close()
+	if _, code := dial("?invite="+inv.Token, "198.51.100.7"); code != http.StatusForbidden {
+		t.Errorf("joining with a used up invite = %d, want 403", code)
+	}
+	if list, err := listInvites(pool, acme); err != nil || len(list) != 1 || list[0].Uses != 1 || list[0].Pending {
+		t.Errorf("listInvites = %+v, %v; want one used up invite", list, err)
+	}
+
+	forged := inv.Token[:strings.LastIndex(inv.Token, ".")+1] + "forged"
+	if _, code := dial("?invite="+forged, "192.0.2.1"); code != http.StatusForbidden {
+		t.Errorf("joining with a forged invite = %d, want 403", code)
+	}
+
+	// Revoking the invite ends the membership.
+	if found, err := revokeInvite(pool, acme, inv.ID); !found || err != nil {
+		t.Fatalf("revokeInvite = %v, %v", found, err)
+	}
+	waitFor(t, "the member connection alone to be registered", func() bool {
+		n, _ := rr.probe(time.Second)
+		return n == 1
+	})
+	kickNonMembers(acme, inv.ID)
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("member connection closed with %v, want a kick", err)
+			}
+			break
+		}
+	}
+	if _, code := dial("?invite="+inv.Token, "192.0.2.1"); code != http.StatusForbidden {
+		t.Errorf("joining with a revoked invite = %d, want 403", code)
+	}
+	waitFor(t, "the connections to be deregistered", func() bool {
+		n, _ := rr.probe(time.Second)
+		return n == 0
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"time"
@@ -10,62 +11,118 @@ import (
 )
 
 var (
-	waitTimeout = time.Minute * 10
-	log         = logrus.WithField("cmd", "go-websocket-chat-demo")
-	rr          redisReceiver
-	rw          redisWriter
+	log = logrus.WithField("cmd", "go-websocket-chat-demo")
+	rr  redisReceiver
+	rw  redisWriter
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if err := runCommand(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
 	}
+}
 
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379"
-	}
+// serve the chat application. This is what the binary does when it is run
+// without a subcommand.
+// args are the flags it was started with, which are reapplied when the
+// configuration is reloaded.
+func serve(c *config, args []string) {
+	currentConfig.Store(c)
+	level, _ := logrus.ParseLevel(c.LogLevel)
+	logrus.SetLevel(level)
+	c.logEffective()
+
+	upgrader.ReadBufferSize = c.ReadBufferSize
+	upgrader.WriteBufferSize = c.WriteBufferSize
+	tracer.configure(c)
+
+	redisURL := c.RedisURL
 	redisPool, err := redigo.NewRedisPoolFromURL(redisURL)
 	if err != nil {
-		log.WithField("url", redisURL).Fatal("Unable to create Redis pool")
+		log.Fatal("Unable to create Redis pool")
 	}
 
 	rr = newRedisReceiver(redisPool)
 	rw = newRedisWriter(redisPool)
+	registerQueueMetrics()
+
+	if c.TranscriptDir != "" {
+		if transcripts, err = newTranscriptSink(c.TranscriptDir); err != nil {
+			log.WithField("err", err).Fatal("Unable to start the transcript sink")
+		}
+		go transcripts.run()
+	}
+
+	go tracer.run()
+	go rr.connHandler()
+	go handleSignals()
+	go handleReloadSignal(redisPool, args)
+	go runRegistry(redisPool)
 
 	go func() {
 		for {
+			waitTimeout := cfg().WaitTimeout
 			waited, err := redigo.WaitForAvailability(redisURL, waitTimeout, rr.wait)
 			if !waited || err != nil {
 				log.WithFields(logrus.Fields{"waitTimeout": waitTimeout, "err": err}).Fatal("Redis not available by timeout!")
 			}
 			rr.broadcast(availableMessage)
 			err = rr.run()
+			rr.state.set(false, err)
 			if err == nil {
 				break
 			}
-			log.WithField("err", err).Error("Redis receiver error, reconnecting in 5 seconds...")
-			time.Sleep(5 * time.Second)
+			delay := cfg().ReconnectDelay
+			log.WithFields(logrus.Fields{"err": err, "delay": delay}).Error("Redis receiver error, reconnecting...")
+			redisReconnects.inc(instance, "receiver")
+			time.Sleep(delay)
 		}
 	}()
 
 	go func() {
 		for {
+			waitTimeout := cfg().WaitTimeout
 			waited, err := redigo.WaitForAvailability(redisURL, waitTimeout, nil)
 			if !waited || err != nil {
 				log.WithFields(logrus.Fields{"waitTimeout": waitTimeout, "err": err}).Fatal("Redis not available by timeout!")
 			}
 			err = rw.run()
+			rw.state.set(false, err)
 			if err == nil {
 				break
 			}
-			log.WithField("err", err).Error("Redis writer error, reconnecting in 5 seconds...")
-			time.Sleep(5 * time.Second)
+			delay := cfg().ReconnectDelay
+			log.WithFields(logrus.Fields{"err": err, "delay": delay}).Error("Redis writer error, reconnecting...")
+			redisReconnects.inc(instance, "writer")
+			time.Sleep(delay)
 		}
 	}()
 
 	http.Handle("/", http.FileServer(http.Dir("./public")))
 	http.HandleFunc("/ws", handleWebsocket)
-	log.Println(http.ListenAndServe(":"+port, nil))
+	http.HandleFunc("/snippets/", handleSnippetFile)
+	http.HandleFunc("/emoji", handleEmoji)
+	http.HandleFunc("/emoji/", handleEmoji)
+	http.Handle("/metrics", metrics)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+
+	widgets := &widgetHandler{pool: redisPool}
+	http.HandleFunc("/widget/config", widgets.handleConfig)
+	http.HandleFunc("/widget/token", widgets.handleToken)
+
+	if adminHandler := newAdminHandler(c.AdminToken, redisPool); adminHandler == nil {
+		log.Info("ADMIN_TOKEN is not set, the admin surface is disabled")
+	} else if c.AdminPort != "" {
+		go func() {
+			log.WithField("port", c.AdminPort).Info("Serving admin surface")
+			log.Println(http.ListenAndServe(":"+c.AdminPort, adminHandler))
+		}()
+	} else {
+		http.Handle("/admin/", adminHandler)
+		http.Handle("/debug/status", adminHandler)
+	}
+
+	log.Println(http.ListenAndServe(":"+c.Port, nil))
 }
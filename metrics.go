@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricKind is the Prometheus metric type of a family.
+type metricKind string
+
+const (
+	counterKind   metricKind = "counter"
+	gaugeKind     metricKind = "gauge"
+	histogramKind metricKind = "histogram"
+)
+
+// defaultBuckets are the histogram upper bounds, in seconds, used for latency
+// metrics. They go from 100µs to 5s which covers a healthy local Redis as
+// well as a struggling hosted one.
+var defaultBuckets = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// series holds the value of one metric family for one set of label values.
+type series struct {
+	labelValues []string
+
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// metricFamily is a named metric with a fixed set of label names. Series are
+// created lazily the first time a set of label values is used.
+type metricFamily struct {
+	name       string
+	help       string
+	kind       metricKind
+	labelNames []string
+	buckets    []float64
+
+	// valueFunc, when set, makes this a gauge that is sampled at scrape time.
+	valueFunc func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (f *metricFamily) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == histogramKind {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// add the provided delta to the series identified by labelValues.
+func (f *metricFamily) add(delta float64, labelValues ...string) {
+	f.mu.Lock()
+	f.get(labelValues).value += delta
+	f.mu.Unlock()
+}
+
+// inc increments the series identified by labelValues by one.
+func (f *metricFamily) inc(labelValues ...string) {
+	f.add(1, labelValues...)
+}
+
+// dec decrements the series identified by labelValues by one.
+func (f *metricFamily) dec(labelValues ...string) {
+	f.add(-1, labelValues...)
+}
+
+// value returns the current value of the series identified by labelValues.
+func (f *metricFamily) value(labelValues ...string) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.get(labelValues).value
+}
+
+// observe records v in the histogram series identified by labelValues.
+func (f *metricFamily) observe(v float64, labelValues ...string) {
+	f.mu.Lock()
+	s := f.get(labelValues)
+	for i, upper := range f.buckets {
+		if v <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+	f.mu.Unlock()
+}
+
+// observeSince records the seconds elapsed since start.
+func (f *metricFamily) observeSince(start time.Time, labelValues ...string) {
+	f.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	if f.valueFunc != nil {
+		fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.valueFunc()))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := f.series[k]
+		labels := formatLabels(f.labelNames, s.labelValues)
+		if f.kind != histogramKind {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatFloat(s.value))
+			continue
+		}
+		names := append(append([]string(nil), f.labelNames...), "le")
+		values := append(append([]string(nil), s.labelValues...), "")
+		for i, upper := range f.buckets {
+			values[len(values)-1] = formatFloat(upper)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(names, values), s.buckets[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsRegistry is the set of metric families exposed on /metrics.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+func (r *metricsRegistry) register(f *metricFamily) *metricFamily {
+	f.series = make(map[string]*series)
+	if f.kind == histogramKind && f.buckets == nil {
+		f.buckets = defaultBuckets
+	}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+func (r *metricsRegistry) counter(name, help string, labelNames ...string) *metricFamily {
+	return r.register(&metricFamily{name: name, help: help, kind: counterKind, labelNames: labelNames})
+}
+
+func (r *metricsRegistry) gauge(name, help string, labelNames ...string) *metricFamily {
+	return r.register(&metricFamily{name: name, help: help, kind: gaugeKind, labelNames: labelNames})
+}
+
+func (r *metricsRegistry) gaugeFunc(name, help string, fn func() float64) *metricFamily {
+	return r.register(&metricFamily{name: name, help: help, kind: gaugeKind, valueFunc: fn})
+}
+
+func (r *metricsRegistry) histogram(name, help string, labelNames ...string) *metricFamily {
+	return r.register(&metricFamily{name: name, help: help, kind: histogramKind, labelNames: labelNames})
+}
+
+// ServeHTTP writes all registered metrics in the Prometheus text format.
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	families := append([]*metricFamily(nil), r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+// instanceName identifies this process in metric labels. On Heroku it is the
+// dyno name, elsewhere the hostname.
+func instanceName() string {
+	if dyno := os.Getenv("DYNO"); dyno != "" {
+		return dyno
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "unknown"
+}
+
+// Reasons used for the rejected messages metric.
+const (
+	rejectInvalid        = "invalid"
+	rejectUnknownType    = "unknown_type"
+	rejectFromRedis      = "invalid_from_redis"
+	rejectBanned         = "banned"
+	rejectQuota          = "quota"
+	rejectHandle         = "handle_mismatch"
+	rejectPending        = "pending"
+	rejectReadOnly       = "read_only"
+	rejectSlowMode       = "slow_mode"
+	rejectGuestLink      = "guest_link"
+	rejectGuestRate      = "guest_rate"
+	rejectStorage        = "storage_quota"
+	rejectQuestionClosed = "question_closed"
+	rejectPrivate        = "private_room"
+)
+
+var (
+	metrics  = &metricsRegistry{}
+	instance = instanceName()
+
+	activeConnections = metrics.gauge("chat_active_connections",
+		"Number of open websocket connections.", "instance", "room")
+	activeGuests = metrics.gauge("chat_active_guests",
+		"Number of open websocket connections of widget guests.", "instance", "room")
+	messagesIn = metrics.counter("chat_messages_received_total",
+		"Messages received from websocket clients.", "instance")
+	messagesOut = metrics.counter("chat_messages_sent_total",
+		"Messages written to websocket clients.", "instance")
+	rejectedMessages = metrics.counter("chat_messages_rejected_total",
+		"Messages that were dropped, by reason.", "instance", "reason")
+	redisReconnects = metrics.counter("chat_redis_reconnects_total",
+		"Times a Redis loop was restarted after an error.", "instance", "component")
+	publishLatency = metrics.histogram("chat_redis_publish_duration_seconds",
+		"Time taken to PUBLISH a message to Redis.", "instance")
+	fanoutDuration = metrics.histogram("chat_broadcast_fanout_duration_seconds",
+		"Time taken to queue one message for every connection.", "instance")
+	connectionWriteErrors = metrics.counter("chat_connection_write_errors_total",
+		"Connections dropped because a write to them failed or timed out.", "instance")
+	sendQueueOverflows = metrics.counter("chat_send_queue_overflows_total",
+		"Connections dropped because their send queue was full.", "instance")
+	transcriptDrops = metrics.counter("chat_transcript_dropped_total",
+		"Messages left out of a transcript because its queue was full.", "instance")
+)
+
+// registerQueueMetrics exposes the depth of the receiver and writer queues.
+// It has to be called once rr and rw have been created.
+func registerQueueMetrics() {
+	metrics.gaugeFunc("chat_redis_receiver_queue_depth",
+		"Messages waiting to be broadcast to websocket clients.",
+		func() float64 { return float64(len(rr.messages)) })
+	metrics.gaugeFunc("chat_redis_writer_queue_depth",
+		"Messages waiting to be published to Redis.",
+		func() float64 { return float64(len(rw.messages)) })
+}
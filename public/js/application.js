@@ -838,7 +838,7 @@ class ConnectionStatusManager {
     
     try {
       // Create new WebSocket connection
-      box = new ReconnectingWebSocket(location.protocol.replace("http","ws") + "//" + location.host + "/ws");
+      box = new ReconnectingWebSocket(location.protocol.replace("http","ws") + "//" + location.host + "/ws" + location.search);
       this.setupWebSocketHandlers();
     } catch (error) {
       console.error('Reconnection failed:', error);
@@ -990,7 +990,7 @@ class WebSocketManager {
    */
   connect() {
     try {
-      const wsUrl = location.protocol.replace("http", "ws") + "//" + location.host + "/ws";
+      const wsUrl = location.protocol.replace("http", "ws") + "//" + location.host + "/ws" + location.search;
       this.websocket = new ReconnectingWebSocket(wsUrl);
       this.setupWebSocketHandlers();
       this.chatState.setConnectionStatus('connecting');
@@ -1102,6 +1102,12 @@ class WebSocketManager {
         return data.text;
       case 'pong':
         return data.timestamp;
+      case 'qa_ranking':
+        return Array.isArray(data.questions);
+      case 'snippet':
+        // Only snippet frames built by the server carry these links
+        return typeof data.id === 'string' && typeof data.html === 'string' &&
+          data.raw_url === `/snippets/${data.id}/raw`;
       default:
         // Legacy format validation
         return data.handle && data.text;
@@ -1424,6 +1430,15 @@ class WebSocketManager {
     return this.sendMessage(messageData);
   }
 
+  /**
+   * Upvote a question in a Q&A room. The server counts one vote per voter.
+   * @param {string} id - Question ID
+   * @returns {Promise} Promise that resolves when sent
+   */
+  sendUpvote(id) {
+    return this.sendMessage({ type: 'upvote', id: id });
+  }
+
   /**
    * Send user status update
    * @param {string} handle - User handle
@@ -1759,6 +1774,18 @@ class MessageRouter {
       this.chatState.emit('heartbeatResponse', data);
       return data;
     });
+
+    // Code snippets, highlighted by the server. The html is escaped there.
+    this.registerHandler('snippet', (data) => {
+      this.chatState.emit('snippetReceived', data);
+      return data;
+    });
+
+    // Q&A mode ranking of open questions
+    this.registerHandler('qa_ranking', (data) => {
+      this.chatState.emit('qaRanking', data.questions);
+      return data;
+    });
   }
 
   /**
@@ -5674,6 +5701,137 @@ class MessageInputEnhancer {
   }
 }
 
+/**
+ * Emoji picker inserting shortcodes into the message input. The registry of
+ * standard and custom emoji comes from the server, which expands the
+ * shortcodes of sent messages.
+ */
+class EmojiPicker {
+  constructor() {
+    this.button = document.querySelector('.emoji-button');
+    this.panel = document.getElementById('emoji-picker');
+    this.registry = null;
+
+    this.init();
+  }
+
+  /**
+   * Initialize the picker
+   */
+  init() {
+    if (!this.button || !this.panel) return;
+
+    this.button.addEventListener('click', () => this.toggle());
+    document.addEventListener('click', (e) => {
+      if (!this.panel.hidden && !this.panel.contains(e.target) && !this.button.contains(e.target)) {
+        this.close();
+      }
+    });
+    this.panel.addEventListener('keydown', (e) => {
+      if (e.key === 'Escape') {
+        this.close();
+        this.button.focus();
+      }
+    });
+  }
+
+  /**
+   * Open or close the picker, loading the registry the first time
+   */
+  toggle() {
+    if (!this.panel.hidden) {
+      this.close();
+      return;
+    }
+    this.load().then(() => {
+      this.panel.hidden = false;
+      this.button.setAttribute('aria-expanded', 'true');
+    }).catch((error) => console.warn('Unable to load emoji:', error));
+  }
+
+  /**
+   * Close the picker
+   */
+  close() {
+    this.panel.hidden = true;
+    this.button.setAttribute('aria-expanded', 'false');
+  }
+
+  /**
+   * Fetch the emoji registry of the tenant, selected like for the websocket
+   * @returns {Promise} Promise that resolves once the picker is rendered
+   */
+  load() {
+    if (this.registry) return Promise.resolve();
+    return fetch('/emoji' + location.search)
+      .then((response) => {
+        if (!response.ok) throw new Error(response.statusText);
+        return response.json();
+      })
+      .then((registry) => {
+        this.registry = registry;
+        this.render();
+      });
+  }
+
+  /**
+   * Render the custom emoji of the tenant followed by the standard ones
+   */
+  render() {
+    this.panel.textContent = '';
+    Object.keys(this.registry.custom || {}).sort().forEach((name) => {
+      const image = document.createElement('img');
+      image.src = this.registry.custom[name].url;
+      image.alt = `:${name}:`;
+      image.width = 20;
+      image.height = 20;
+      this.panel.appendChild(this.createItem(name, image));
+    });
+    Object.keys(this.registry.standard || {}).sort().forEach((name) => {
+      this.panel.appendChild(this.createItem(name, document.createTextNode(this.registry.standard[name])));
+    });
+  }
+
+  /**
+   * Create the button inserting the shortcode of an emoji
+   * @param {string} name - Shortcode without colons
+   * @param {Node} content - Image or character of the emoji
+   * @returns {HTMLElement} Button element
+   */
+  createItem(name, content) {
+    const item = document.createElement('button');
+    item.type = 'button';
+    item.className = 'emoji-item';
+    item.title = `:${name}:`;
+    item.appendChild(content);
+    item.addEventListener('click', () => this.insert(`:${name}:`));
+    return item;
+  }
+
+  /**
+   * Insert a shortcode at the cursor of the message input
+   * @param {string} code - Shortcode
+   */
+  insert(code) {
+    const input = document.getElementById('message-input');
+    if (!input) return;
+
+    const start = input.selectionStart || 0;
+    const end = input.selectionEnd || 0;
+    const value = input.value.slice(0, start) + code + input.value.slice(end);
+    if (messageInputEnhancer) {
+      messageInputEnhancer.setValue(value);
+    } else {
+      input.value = value;
+    }
+    input.focus();
+    input.setSelectionRange(start + code.length, start + code.length);
+    this.close();
+  }
+}
+
+let emojiPicker = null;
+
 // Initialize message input enhancer
 let messageInputEnhancer = null;
 
@@ -5720,6 +5878,7 @@ $(document).ready(function() {
   
   // Initialize message input enhancer
   messageInputEnhancer = new MessageInputEnhancer();
+  emojiPicker = new EmojiPicker();
 });
 
 /**
@@ -9612,6 +9771,15 @@ class UIInteractionManager {
       this.updateMessageInUI(message);
     });
 
+    this.chatState.on('qaRanking', (questions) => {
+      this.renderQARanking(questions);
+    });
+
+    this.chatState.on('snippetReceived', (data) => {
+      this.addSnippetToUI(data);
+      this.updateLastMessageTime();
+    });
+
     // Connection events
     this.chatState.on('connectionStatusChanged', (status) => {
       this.updateConnectionStatusUI(status);
@@ -10055,6 +10223,133 @@ class UIInteractionManager {
     this.animateMessageEntrance(messageElement);
   }
 
+  /**
+   * Render the Q&A ranking of open questions, hiding it when there are none
+   * @param {Array} questions - Open questions, most voted first
+   */
+  renderQARanking(questions) {
+    const section = document.getElementById('qa-ranking');
+    const list = document.getElementById('qa-ranking-list');
+    if (!section || !list) return;
+
+    list.textContent = '';
+    section.hidden = questions.length === 0;
+    questions.forEach((question) => {
+      const item = document.createElement('li');
+      item.className = 'qa-question';
+
+      const votes = document.createElement('button');
+      votes.type = 'button';
+      votes.className = 'qa-upvote';
+      votes.textContent = `▲ ${question.votes}`;
+      votes.setAttribute('aria-label', `为问题投票，当前 ${question.votes} 票`);
+      votes.addEventListener('click', () => {
+        votes.disabled = true;
+        webSocketManager.sendUpvote(question.id)
+          .catch((error) => console.warn('Unable to upvote:', error));
+      });
+
+      const text = document.createElement('span');
+      text.className = 'qa-text';
+      text.textContent = question.text;
+
+      const handle = document.createElement('span');
+      handle.className = 'qa-handle';
+      handle.textContent = question.handle;
+
+      item.appendChild(votes);
+      item.appendChild(text);
+      item.appendChild(handle);
+      list.appendChild(item);
+    });
+  }
+
+  /**
+   * Show highlighted snippet code. The server escapes the code and only
+   * wraps tokens in classed spans, so any other markup is shown as text.
+   * @param {HTMLElement} pre - Element to render into
+   * @param {string} html - Highlighted code
+   */
+  renderSnippetCode(pre, html) {
+    const template = document.createElement('template');
+    template.innerHTML = html;
+    const safe = Array.from(template.content.querySelectorAll('*')).every((node) =>
+      node.tagName === 'SPAN' &&
+      Array.from(node.attributes).every((attribute) => attribute.name === 'class'));
+    if (safe) {
+      pre.textContent = '';
+      pre.appendChild(template.content);
+    } else {
+      pre.textContent = template.content.textContent;
+    }
+  }
+
+  /**
+   * Add a code snippet to UI. Its html is highlighted and escaped by the
+   * server; collapsed snippets only carry their first lines, so expanding
+   * one fetches its raw text.
+   * @param {Object} data - Snippet frame
+   */
+  addSnippetToUI(data) {
+    const messagesContainer = document.getElementById('messages-container') || document.getElementById('chat-text');
+    if (!messagesContainer) return;
+
+    // The snippet endpoints select the tenant like the websocket does
+    const query = location.search;
+    const base = `/snippets/${encodeURIComponent(data.id)}`;
+    const element = createMessageBubble({ handle: data.handle, text: '' });
+    const bubble = element.querySelector('.message-bubble');
+    const pre = document.createElement('pre');
+    pre.className = 'snippet';
+    this.renderSnippetCode(pre, data.html);
+    bubble.textContent = '';
+    bubble.appendChild(pre);
+
+    const actions = document.createElement('div');
+    actions.className = 'snippet-actions';
+    if (data.collapsed) {
+      const collapsedLabel = `展开全部 ${data.lines} 行`;
+      const toggle = document.createElement('button');
+      toggle.type = 'button';
+      toggle.className = 'snippet-toggle';
+      toggle.textContent = collapsedLabel;
+      toggle.setAttribute('aria-expanded', 'false');
+      toggle.addEventListener('click', () => {
+        if (toggle.getAttribute('aria-expanded') === 'true') {
+          this.renderSnippetCode(pre, data.html);
+          toggle.textContent = collapsedLabel;
+          toggle.setAttribute('aria-expanded', 'false');
+          return;
+        }
+        fetch(`${base}/raw${query}`)
+          .then((response) => {
+            if (!response.ok) throw new Error(response.statusText);
+            return response.text();
+          })
+          .then((text) => {
+            pre.textContent = text;
+            toggle.textContent = '收起';
+            toggle.setAttribute('aria-expanded', 'true');
+          })
+          .catch((error) => console.warn('Unable to load snippet:', error));
+      });
+      actions.appendChild(toggle);
+    }
+    [[`${base}/raw`, '原文'], [`${base}/download`, '下载']].forEach(([url, label]) => {
+      const link = document.createElement('a');
+      link.href = url + query;
+      link.textContent = label;
+      link.target = '_blank';
+      link.rel = 'noopener';
+      actions.appendChild(link);
+    });
+    bubble.appendChild(actions);
+
+    messagesContainer.appendChild(element);
+    this.scrollToBottomIfNeeded();
+    this.animateMessageEntrance(element);
+  }
+
   /**
    * Create message element
    * @param {Message} message - Message data
@@ -10958,7 +11253,7 @@ class ApplicationManager {
     // Initialize legacy WebSocket if not already done
     if (typeof box === 'undefined') {
       window.box = new ReconnectingWebSocket(
-        location.protocol.replace("http", "ws") + "//" + location.host + "/ws"
+        location.protocol.replace("http", "ws") + "//" + location.host + "/ws" + location.search
       );
       
       // Setup legacy handlers
@@ -0,0 +1,152 @@
+/**
+ * Embeddable chat widget. Add it to a page with
+ *
+ *   <script src="https://chat.example.com/widget.js" data-site-key="KEY" async></script>
+ *
+ * The site key must be registered through the admin API with the page's
+ * origin. The server checks the origin and signs the guest identity, the
+ * widget only renders.
+ */
+(function () {
+  'use strict';
+
+  var script = document.currentScript;
+  var key = script.getAttribute('data-site-key');
+  var base = new URL(script.src).origin;
+  var storageKey = 'chat-widget-' + key;
+
+  function api(path, method) {
+    return fetch(base + path + '?key=' + encodeURIComponent(key), { method: method || 'GET' })
+      .then(function (res) {
+        if (!res.ok) {
+          throw new Error('chat widget: ' + path + ' returned ' + res.status);
+        }
+        return res.json();
+      });
+  }
+
+  // guest returns the guest identity issued to this visitor, reusing it
+  // until it expires.
+  function guest() {
+    try {
+      var saved = JSON.parse(localStorage.getItem(storageKey));
+      if (saved && new Date(saved.expires_at) > new Date(Date.now() + 60000)) {
+        return Promise.resolve(saved);
+      }
+    } catch (e) {}
+    return api('/widget/token', 'POST').then(function (g) {
+      try { localStorage.setItem(storageKey, JSON.stringify(g)); } catch (e) {}
+      return g;
+    });
+  }
+
+  function el(tag, style, text) {
+    var e = document.createElement(tag);
+    e.style.cssText = style;
+    if (text) {
+      e.textContent = text;
+    }
+    return e;
+  }
+
+  function render(config, identity) {
+    var side = config.position + ':20px;';
+    var button = el('button', 'position:fixed;bottom:20px;' + side + 'z-index:2147483647;border:0;border-radius:24px;' +
+      'padding:12px 18px;color:#fff;cursor:pointer;font:14px sans-serif;background:' + config.color, config.title);
+    var panel = el('div', 'position:fixed;bottom:70px;' + side + 'z-index:2147483647;width:300px;height:400px;' +
+      'display:none;flex-direction:column;background:#fff;border:1px solid #ccc;border-radius:8px;font:14px sans-serif;overflow:hidden');
+    var header = el('div', 'padding:10px;color:#fff;background:' + config.color, config.title);
+    var log = el('div', 'flex:1;overflow-y:auto;padding:10px');
+    var form = el('form', 'display:flex;border-top:1px solid #ccc');
+    var input = el('input', 'flex:1;border:0;padding:10px;font:inherit');
+    input.placeholder = 'Message';
+    form.appendChild(input);
+    panel.appendChild(header);
+    panel.appendChild(log);
+    panel.appendChild(form);
+    document.body.appendChild(panel);
+    document.body.appendChild(button);
+
+    function show(handle, text) {
+      var line = el('div', 'margin-bottom:6px');
+      line.appendChild(el('strong', '', handle + ': '));
+      line.appendChild(document.createTextNode(text));
+      log.appendChild(line);
+      log.scrollTop = log.scrollHeight;
+    }
+
+    // showSnippet links to the raw text of a snippet, which is too wide for
+    // the panel.
+    function showSnippet(msg) {
+      var line = el('div', 'margin-bottom:6px');
+      var link = el('a', '', (msg.lang || 'text') + ', ' + msg.lines + ' lines');
+      link.href = base + '/snippets/' + encodeURIComponent(msg.id) + '/raw?widget_token=' + encodeURIComponent(identity.token);
+      link.target = '_blank';
+      link.rel = 'noopener';
+      line.appendChild(el('strong', '', msg.handle + ': '));
+      line.appendChild(link);
+      log.appendChild(line);
+      log.scrollTop = log.scrollHeight;
+    }
+
+    function toggle(open) {
+      panel.style.display = open ? 'flex' : 'none';
+    }
+    button.addEventListener('click', function () {
+      toggle(panel.style.display === 'none');
+    });
+    toggle(config.start_open);
+    if (config.greeting) {
+      show(config.title, config.greeting);
+    }
+
+    var ws;
+    function open() {
+      ws = new WebSocket(base.replace(/^http/, 'ws') + '/ws?widget_token=' + encodeURIComponent(identity.token));
+      ws.onmessage = function (e) {
+        var msg = JSON.parse(e.data);
+        switch (msg.type) {
+          case 'snippet':
+            showSnippet(msg);
+            break;
+          case undefined:
+          case '':
+            show(msg.handle, msg.text);
+            break;
+          default:
+            // Other frames, such as the Q&A ranking, have no place in the
+            // panel.
+        }
+      };
+      ws.onclose = function () {
+        setTimeout(reconnect, 5000);
+      };
+    }
+    // reconnect with a new identity if the previous one has expired.
+    function reconnect() {
+      guest().then(function (g) {
+        identity = g;
+        open();
+      }, function () {
+        setTimeout(reconnect, 5000);
+      });
+    }
+    open();
+
+    form.addEventListener('submit', function (e) {
+      e.preventDefault();
+      if (input.value && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ handle: identity.handle, text: input.value }));
+        input.value = '';
+      }
+    });
+  }
+
+  Promise.all([api('/widget/config'), guest()])
+    .then(function (results) {
+      render(results[0], results[1]);
+    })
+    .catch(function (err) {
+      console.error(err);
+    });
+})();
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// In Q&A mode messages become questions, which the audience upvotes and
+// hosts mark answered or dismissed through the admin API. The questions of a
+// tenant are kept in its namespace:
+//
+//   qa:questions  hash of question ID to JSON question
+//   qa:ranking    sorted set of the open question IDs by votes
+//   qa:voters:ID  set of the voters of a question
+//   qa:dedup      hash of normalized question text to question ID
+
+// Question statuses.
+const (
+	questionOpen      = "open"
+	questionAnswered  = "answered"
+	questionDismissed = "dismissed"
+)
+
+// qaRankingSize is the number of open questions pushed to clients.
+const qaRankingSize = 50
+
+// errQuestionClosed is returned for votes for, and repeats of, a question
+// that has been answered or dismissed. Hosts can reopen it.
+var errQuestionClosed = errors.New("question is closed")
+
+type question struct {
+	ID       string     `json:"id"`
+	Text     string     `json:"text"`
+	Handle   string     `json:"handle,omitempty"`
+	Status   string     `json:"status"`
+	Votes    int        `json:"votes"`
+	AskedAt  time.Time  `json:"asked_at"`
+	ClosedAt *time.Time `json:"closed_at,omitempty"`
+}
+
+// qaRanking is the frame pushed to clients whenever the ranking changes.
+type qaRanking struct {
+	Type      string     `json:"type"`
+	Questions []question `json:"questions"`
+}
+
+var nonWord = regexp.MustCompile(`[^\pL\pN]+`)
+
+// normalizeQuestion reduces a question to lower case words so that the same
+// question asked twice is recognized.
+func normalizeQuestion(text string) string {
+	return strings.TrimSpace(nonWord.ReplaceAllString(strings.ToLower(text), " "))
+}
+
+// handleQA applies a message received in Q&A mode: upvote messages vote for
+// a question, chat and question messages ask one. The new ranking is then pushed to
+// every connection of t.
+func handleQA(pool *redis.Pool, t *tenant, c *client, msg message) error {
+	var err error
+	switch msg.Type {
+	case messageUpvote:
+		err = upvoteQuestion(pool, t, msg.ID, c.voter())
+	case "", messageQuestion:
+		err = askQuestion(pool, t, msg.Handle, msg.Text, c.voter())
+	default:
+		err = errors.Errorf("%s messages can't be sent in Q&A mode", msg.Type)
+	}
+	if err != nil {
+		return err
+	}
+	return publishRanking(pool, t)
+}
+
+// askQuestion records a question. If the same question has already been
+// asked it counts as an upvote by voter instead, which fails with
+// errQuestionClosed if the question has been closed since.
+func askQuestion(pool *redis.Pool, t *tenant, handle, text, voter string) error {
+	norm := normalizeQuestion(text)
+	if norm == "" {
+		return errors.New("Question is empty")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	id := newID()
+	created, err := redis.Int(conn.Do("HSETNX", t.key("qa", "dedup"), norm, id))
+	if err != nil {
+		return errors.Wrap(err, "Unable to record question")
+	}
+	if created == 0 {
+		existing, err := redis.String(conn.Do("HGET", t.key("qa", "dedup"), norm))
+		if err != nil {
+			return errors.Wrap(err, "Unable to find duplicate question")
+		}
+		return upvoteQuestion(pool, t, existing, voter)
+	}
+	data, err := json.Marshal(question{
+		ID:      id,
+		Text:    text,
+		Handle:  handle,
+		Status:  questionOpen,
+		AskedAt: time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Marshaling question")
+	}
+	if err := t.reserveStorage(conn, "qa:"+id, len(data)+len(norm), 0); err != nil {
+		conn.Do("HDEL", t.key("qa", "dedup"), norm)
+		return err
+	}
+	conn.Send("MULTI")
+	conn.Send("HSET", t.key("qa", "questions"), id, data)
+	conn.Send("ZADD", t.key("qa", "ranking"), 0, id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return errors.Wrap(err, "Unable to record question")
+	}
+	return nil
+}
+
+// upvoteQuestion counts a vote by voter for an open question. Each voter
+// counts once.
+func upvoteQuestion(pool *redis.Pool, t *tenant, id, voter string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := redis.Float64(conn.Do("ZSCORE", t.key("qa", "ranking"), id)); err == redis.ErrNil {
+		exists, err := redis.Bool(conn.Do("HEXISTS", t.key("qa", "questions"), id))
+		if err != nil {
+			return errors.Wrap(err, "Unable to read question")
+		}
+		if exists {
+			return errors.Wrapf(errQuestionClosed, "Question %q", id)
+		}
+		return errors.Errorf("No question %q", id)
+	} else if err != nil {
+		return errors.Wrap(err, "Unable to read question")
+	}
+	added, err := redis.Int(conn.Do("SADD", t.key("qa", "voters", id), voter))
+	if err != nil {
+		return errors.Wrap(err, "Unable to record vote")
+	}
+	if added == 0 {
+		return nil
+	}
+	// XX leaves out questions closed since they were checked above.
+	if _, err := conn.Do("ZADD", t.key("qa", "ranking"), "XX", "INCR", 1, id); err != nil {
+		return errors.Wrap(err, "Unable to record vote")
+	}
+	return nil
+}
+
+// rankedQuestions returns the open questions of t with the most votes.
+func rankedQuestions(conn redis.Conn, t *tenant, n int) ([]question, error) {
+	values, err := redis.Values(conn.Do("ZREVRANGE", t.key("qa", "ranking"), 0, n-1, "WITHSCORES"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read ranking")
+	}
+	var ranking []struct {
+		ID    string
+		Votes int
+	}
+	if err := redis.ScanSlice(values, &ranking); err != nil {
+		return nil, errors.Wrap(err, "Unable to read ranking")
+	}
+	questions := make([]question, 0, len(ranking))
+	if len(ranking) == 0 {
+		return questions, nil
+	}
+	args := redis.Args{}.Add(t.key("qa", "questions"))
+	for _, r := range ranking {
+		args = args.Add(r.ID)
+	}
+	datas, err := redis.ByteSlices(conn.Do("HMGET", args...))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read questions")
+	}
+	for i, data := range datas {
+		var q question
+		if data == nil || json.Unmarshal(data, &q) != nil {
+			continue
+		}
+		q.Votes = ranking[i].Votes
+		questions = append(questions, q)
+	}
+	return questions, nil
+}
+
+// publishRanking pushes the ranking of open questions to every connection
+// of t.
+func publishRanking(pool *redis.Pool, t *tenant) error {
+	conn := pool.Get()
+	defer conn.Close()
+	questions, err := rankedQuestions(conn, t, qaRankingSize)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(qaRanking{Type: frameQARanking, Questions: questions})
+	if err != nil {
+		return errors.Wrap(err, "Marshaling ranking")
+	}
+	rw.publish(t, data)
+	return nil
+}
+
+// listQuestions returns every question of t: the open ones by votes, then
+// the answered and dismissed ones, most recently closed first.
+func listQuestions(pool *redis.Pool, t *tenant) ([]question, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", t.key("qa", "questions")))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list questions")
+	}
+	questions := make([]question, 0, len(values))
+	for id, data := range values {
+		var q question
+		if err := json.Unmarshal([]byte(data), &q); err != nil {
+			return nil, errors.Wrapf(err, "Unmarshaling question %s", id)
+		}
+		conn.Send("SCARD", t.key("qa", "voters", id))
+		questions = append(questions, q)
+	}
+	conn.Flush()
+	for i := range questions {
+		if questions[i].Votes, err = redis.Int(conn.Receive()); err != nil {
+			return nil, errors.Wrap(err, "Unable to count votes")
+		}
+	}
+	sort.Slice(questions, func(i, j int) bool {
+		a, b := questions[i], questions[j]
+		if (a.Status == questionOpen) != (b.Status == questionOpen) {
+			return a.Status == questionOpen
+		}
+		if a.Status == questionOpen {
+			if a.Votes != b.Votes {
+				return a.Votes > b.Votes
+			}
+			return a.AskedAt.Before(b.AskedAt)
+		}
+		if a.ClosedAt == nil || b.ClosedAt == nil {
+			return a.AskedAt.Before(b.AskedAt)
+		}
+		return a.ClosedAt.After(*b.ClosedAt)
+	})
+	return questions, nil
+}
+
+// setQuestionStatus marks a question answered or dismissed, or reopens it,
+// and pushes the new ranking.
+func setQuestionStatus(pool *redis.Pool, t *tenant, id, status string) (*question, error) {
+	if status != questionOpen && status != questionAnswered && status != questionDismissed {
+		return nil, errors.Errorf("status %q must be open, answered or dismissed", status)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("HGET", t.key("qa", "questions"), id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read question")
+	}
+	var q question
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, errors.Wrapf(err, "Unmarshaling question %s", id)
+	}
+	q.Status = status
+	q.ClosedAt = nil
+	if status != questionOpen {
+		now := time.Now()
+		q.ClosedAt = &now
+	}
+	if q.Votes, err = redis.Int(conn.Do("SCARD", t.key("qa", "voters", id))); err != nil {
+		return nil, errors.Wrap(err, "Unable to count votes")
+	}
+	if data, err = json.Marshal(q); err != nil {
+		return nil, errors.Wrap(err, "Marshaling question")
+	}
+	conn.Send("MULTI")
+	conn.Send("HSET", t.key("qa", "questions"), id, data)
+	if status == questionOpen {
+		conn.Send("ZADD", t.key("qa", "ranking"), q.Votes, id)
+	} else {
+		conn.Send("ZREM", t.key("qa", "ranking"), id)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, errors.Wrap(err, "Unable to update question")
+	}
+	return &q, publishRanking(pool, t)
+}
+
+// clearQuestions removes every question of t, ready for the next event.
+func clearQuestions(pool *redis.Pool, t *tenant) error {
+	conn := pool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("HKEYS", t.key("qa", "questions")))
+	if err != nil {
+		return errors.Wrap(err, "Unable to list questions")
+	}
+	keys := redis.Args{}.Add(t.key("qa", "questions"), t.key("qa", "ranking"), t.key("qa", "dedup"))
+	for _, id := range ids {
+		keys = keys.Add(t.key("qa", "voters", id))
+	}
+	if _, err := conn.Do("DEL", keys...); err != nil {
+		return errors.Wrap(err, "Unable to clear questions")
+	}
+	items := make([]string, len(ids))
+	for i, id := range ids {
+		items[i] = "qa:" + id
+	}
+	if err := t.releaseStorage(conn, items...); err != nil {
+		return err
+	}
+	return publishRanking(pool, t)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestClosedQuestion(t *testing.T) {
+	_, pool := testHub(t)
+	if err := askQuestion(pool, defaultTenant, "ann", "Is it recorded?", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	qs, err := listQuestions(pool, defaultTenant)
+	if err != nil || len(qs) != 1 {
+		t.Fatalf("listQuestions = %v, %v", qs, err)
+	}
+	id := qs[0].ID
+	if _, err := setQuestionStatus(pool, defaultTenant, id, questionAnswered); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := askQuestion(pool, defaultTenant, "bob", "is it recorded", "v2"); errors.Cause(err) != errQuestionClosed {
+		t.Errorf("asking a closed question again = %v, want errQuestionClosed", err)
+	}
+	if err := upvoteQuestion(pool, defaultTenant, id, "v2"); errors.Cause(err) != errQuestionClosed {
+		t.Errorf("upvoting a closed question = %v, want errQuestionClosed", err)
+	}
+	if err := upvoteQuestion(pool, defaultTenant, "missing", "v2"); err == nil || errors.Cause(err) == errQuestionClosed {
+		t.Errorf("upvoting an unknown question = %v, want another error", err)
+	}
+
+	// Once reopened it takes votes again.
+	if _, err := setQuestionStatus(pool, defaultTenant, id, questionOpen); err != nil {
+		t.Fatal(err)
+	}
+	if err := askQuestion(pool, defaultTenant, "bob", "is it recorded", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if qs, _ = listQuestions(pool, defaultTenant); len(qs) != 1 || qs[0].Votes != 1 {
+		t.Errorf("questions after reopening = %+v, want one with 1 vote", qs)
+	}
+}
@@ -2,11 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
-	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -18,7 +16,8 @@ const (
 
 var (
 	waitingMessage, availableMessage []byte
-	waitSleep                        = time.Second * 10
+	pendingMessage, approvedMessage  []byte
+	upgradedMessage                  []byte
 )
 
 func init() {
@@ -37,16 +36,56 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	pendingMessage, err = json.Marshal(message{
+		Handle: "system",
+		Text:   "Waiting for a moderator to let you in",
+	})
+	if err != nil {
+		panic(err)
+	}
+	approvedMessage, err = json.Marshal(message{
+		Handle: "system",
+		Text:   "You have been let in",
+	})
+	if err != nil {
+		panic(err)
+	}
+	upgradedMessage, err = json.Marshal(message{
+		Handle: "system",
+		Text:   "You are now a full member",
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// delivery is a message for the connections of a tenant, or of every tenant
+// if tenant is nil.
+type delivery struct {
+	tenant *tenant
+	data   []byte
+}
+
+// connRequest asks the hub to act on a tenant's connection.
+type connRequest struct {
+	tenant string
+	id     string
 }
 
 // redisReceiver receives messages from Redis and broadcasts them to all
 // registered websocket connections that are Registered.
 type redisReceiver struct {
-	pool *redis.Pool
+	pool  *redis.Pool
+	state *loopState
 
-	messages       chan []byte
-	newConnections chan *websocket.Conn
-	rmConnections  chan *websocket.Conn
+	messages       chan delivery
+	newConnections chan *client
+	rmConnections  chan *client
+	probes         chan chan int
+	snapshots      chan chan []clientInfo
+	kicks          chan connRequest
+	approvals      chan connRequest
+	upgrades       chan connRequest
 }
 
 // newRedisReceiver creates a redisReceiver that will use the provided
@@ -54,20 +93,27 @@ type redisReceiver struct {
 func newRedisReceiver(pool *redis.Pool) redisReceiver {
 	return redisReceiver{
 		pool:           pool,
-		messages:       make(chan []byte, 1000), // 1000 is arbitrary
-		newConnections: make(chan *websocket.Conn),
-		rmConnections:  make(chan *websocket.Conn),
+		state:          newLoopState(),
+		messages:       make(chan delivery, cfg().BroadcastQueueSize),
+		newConnections: make(chan *client),
+		rmConnections:  make(chan *client),
+		probes:         make(chan chan int),
+		snapshots:      make(chan chan []clientInfo),
+		kicks:          make(chan connRequest),
+		approvals:      make(chan connRequest),
+		upgrades:       make(chan connRequest),
 	}
 }
 
 func (rr *redisReceiver) wait(_ time.Time) error {
 	rr.broadcast(waitingMessage)
-	time.Sleep(waitSleep)
+	time.Sleep(cfg().WaitSleep)
 	return nil
 }
 
 // run receives pubsub messages from Redis after establishing a connection.
-// When a valid message is received it is broadcast to all connected websockets
+// When a valid message is received it is broadcast to the connected websockets
+// of the tenant whose channel it was published on.
 func (rr *redisReceiver) run() error {
 	l := log.WithField("channel", Channel)
 	conn := rr.pool.Get()
@@ -79,11 +125,26 @@ func (rr *redisReceiver) run() error {
 	}
 
 	psc := redis.PubSubConn{Conn: conn}
-	if err := psc.Subscribe(Channel); err != nil {
+	if err := psc.Subscribe(defaultTenant.channel(), controlChannel); err != nil {
 		return errors.Wrap(err, "Failed to subscribe to Redis channel")
 	}
+	if err := psc.PSubscribe(tenantPattern); err != nil {
+		return errors.Wrap(err, "Failed to subscribe to tenant channels")
+	}
+	rr.state.set(true, nil)
 
-	go rr.connHandler()
+	if err := tenants.load(rr.pool); err != nil {
+		l.WithField("err", err).Error("Unable to load tenants")
+	}
+	if err := bans.loadAll(rr.pool); err != nil {
+		l.WithField("err", err).Error("Unable to load bans")
+	}
+	if err := rooms.loadAll(rr.pool); err != nil {
+		l.WithField("err", err).Error("Unable to load room settings")
+	}
+	if err := customEmojis.loadAll(rr.pool); err != nil {
+		l.WithField("err", err).Error("Unable to load emoji")
+	}
 
 	for {
 		// Set receive timeout to detect connection issues
@@ -91,12 +152,11 @@ func (rr *redisReceiver) run() error {
 
 		switch v := psc.Receive().(type) {
 		case redis.Message:
-			l.WithField("message", string(v.Data)).Info("Redis Message Received")
-			if _, err := validateMessage(v.Data); err != nil {
-				l.WithField("err", err).Error("Error unmarshalling message from Redis")
+			if v.Channel == controlChannel {
+				handleControl(v.Data)
 				continue
 			}
-			rr.broadcast(v.Data)
+			rr.receive(v.Channel, v.Data)
 		case redis.Subscription:
 			l.WithFields(logrus.Fields{
 				"kind":  v.Kind,
@@ -111,49 +171,194 @@ func (rr *redisReceiver) run() error {
 	}
 }
 
+// receive a chat message published on channel.
+func (rr *redisReceiver) receive(channel string, data []byte) {
+	l := log.WithField("channel", channel)
+	id, ok := tenantFromChannel(channel)
+	t := tenants.get(id)
+	if !ok || t == nil {
+		l.Warning("Message received for an unknown tenant")
+		return
+	}
+	l.WithField("message", string(data)).Info("Redis Message Received")
+	receive := tracer.start("redis.receive", extractTraceContext(data))
+	if err := validateFrame(data); err != nil {
+		l.WithField("err", err).Error("Error unmarshalling message from Redis")
+		rejectedMessages.inc(instance, rejectFromRedis)
+		receive.finish(err)
+		return
+	}
+	if transcripts != nil && rooms.get(t).Transcript {
+		transcripts.write(t, data)
+	}
+	rr.broadcastTo(t, injectTraceContext(data, receive.context()))
+	receive.finish(nil)
+}
+
 // broadcast the provided message to all connected websocket connections.
 // If an error occurs while writting a message to a websocket connection it is
 // closed and deregistered.
 func (rr *redisReceiver) broadcast(msg []byte) {
-	rr.messages <- msg
+	rr.messages <- delivery{data: msg}
+}
+
+// broadcastTo sends the provided message to the connections of t.
+func (rr *redisReceiver) broadcastTo(t *tenant, msg []byte) {
+	rr.messages <- delivery{tenant: t, data: msg}
 }
 
 // register the websocket connection with the receiver.
-func (rr *redisReceiver) register(conn *websocket.Conn) {
-	rr.newConnections <- conn
+func (rr *redisReceiver) register(c *client) {
+	rr.newConnections <- c
 }
 
 // deRegister the connection by closing it and removing it from our list.
-func (rr *redisReceiver) deRegister(conn *websocket.Conn) {
-	rr.rmConnections <- conn
+func (rr *redisReceiver) deRegister(c *client) {
+	rr.rmConnections <- c
+}
+
+// clients returns a snapshot of the connections registered on this instance.
+func (rr *redisReceiver) clients() []clientInfo {
+	reply := make(chan []clientInfo, 1)
+	rr.snapshots <- reply
+	return <-reply
+}
+
+// kick closes the connection with the provided id if it is registered on this
+// instance and belongs to the tenant with the provided ID.
+func (rr *redisReceiver) kick(tenant, id string) {
+	rr.kicks <- connRequest{tenant: tenant, id: id}
+}
+
+// approve lets the pending connection with the provided id in if it is
+// registered on this instance and belongs to the tenant with the provided ID.
+// An empty id approves every pending connection of the tenant.
+func (rr *redisReceiver) approve(tenant, id string) {
+	rr.approvals <- connRequest{tenant: tenant, id: id}
 }
 
+// upgrade makes the guest connection with the provided id a full member if it
+// is registered on this instance and belongs to the tenant with the provided
+// ID.
+func (rr *redisReceiver) upgrade(tenant, id string) {
+	rr.upgrades <- connRequest{tenant: tenant, id: id}
+}
+
+// probe checks that connHandler is responsive, returning the number of
+// registered connections. ok is false if it did not answer within timeout.
+func (rr *redisReceiver) probe(timeout time.Duration) (conns int, ok bool) {
+	reply := make(chan int, 1)
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case rr.probes <- reply:
+	case <-t.C:
+		return 0, false
+	}
+	select {
+	case conns = <-reply:
+		return conns, true
+	case <-t.C:
+		return 0, false
+	}
+}
+
+// connHandler is the hub loop owning the list of connections. It must be
+// started once, independently of the Redis connection, so that connections
+// can register and receive system messages while Redis is unavailable.
 func (rr *redisReceiver) connHandler() {
-	conns := make([]*websocket.Conn, 0)
+	conns := make([]*client, 0)
+	// drop removes c from conns and stops its writer.
+	drop := func(c *client) {
+		var found bool
+		if conns, found = removeConn(conns, c); !found {
+			return
+		}
+		close(c.send)
+		activeConnections.dec(instance, c.tenant.channel())
+		if c.guestHandle() != "" {
+			activeGuests.dec(instance, c.tenant.channel())
+		}
+	}
+	// queue hands data to c's writer. A client whose queue is full has
+	// stopped reading, or reads too slowly to keep up, and is disconnected
+	// rather than holding up the others.
+	queue := func(c *client, data []byte, parent spanContext) {
+		select {
+		case c.send <- outgoing{data: data, parent: parent}:
+		default:
+			log.WithFields(logrus.Fields{
+				"conn":   c.id,
+				"tenant": c.tenant.name(),
+			}).Warning("Send queue full! Disconnecting slow connection")
+			sendQueueOverflows.inc(instance)
+			drop(c)
+			go c.kick("Too slow")
+		}
+	}
 	for {
 		select {
-		case msg := <-rr.messages:
-			for _, conn := range conns {
-				if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-					log.WithFields(logrus.Fields{
-						"data": msg,
-						"err":  err,
-						"conn": conn,
-					}).Error("Error writting data to connection! Closing and removing Connection")
-					conns = removeConn(conns, conn)
+		case d := <-rr.messages:
+			start := time.Now()
+			parent := extractTraceContext(d.data)
+			for _, c := range append([]*client(nil), conns...) {
+				if (d.tenant != nil && c.tenant.ID != d.tenant.ID) || c.isPending() {
+					continue
 				}
+				queue(c, d.data, parent)
+			}
+			fanoutDuration.observeSince(start, instance)
+		case c := <-rr.newConnections:
+			conns = append(conns, c)
+			activeConnections.inc(instance, c.tenant.channel())
+			if c.guestHandle() != "" {
+				activeGuests.inc(instance, c.tenant.channel())
+			}
+			if c.isPending() {
+				queue(c, pendingMessage, spanContext{})
+			}
+		case c := <-rr.rmConnections:
+			drop(c)
+		case reply := <-rr.probes:
+			reply <- len(conns)
+		case reply := <-rr.snapshots:
+			infos := make([]clientInfo, 0, len(conns))
+			for _, c := range conns {
+				infos = append(infos, c.info())
+			}
+			reply <- infos
+		case k := <-rr.kicks:
+			for _, c := range conns {
+				if c.id == k.id && c.tenant.ID == k.tenant {
+					go c.kick("Disconnected by an administrator")
+				}
+			}
+		case a := <-rr.approvals:
+			for _, c := range append([]*client(nil), conns...) {
+				if c.tenant.ID != a.tenant || (a.id != "" && c.id != a.id) || !c.approve() {
+					continue
+				}
+				log.WithFields(logrus.Fields{"conn": c.id, "tenant": c.tenant.name()}).Info("Connection approved")
+				queue(c, approvedMessage, spanContext{})
+			}
+		case u := <-rr.upgrades:
+			for _, c := range append([]*client(nil), conns...) {
+				if c.tenant.ID != u.tenant || c.id != u.id || !c.upgrade() {
+					continue
+				}
+				activeGuests.dec(instance, c.tenant.channel())
+				log.WithFields(logrus.Fields{"conn": c.id, "tenant": c.tenant.name()}).Info("Guest upgraded")
+				queue(c, upgradedMessage, spanContext{})
 			}
-		case conn := <-rr.newConnections:
-			conns = append(conns, conn)
-		case conn := <-rr.rmConnections:
-			conns = removeConn(conns, conn)
 		}
 	}
 }
 
-func removeConn(conns []*websocket.Conn, remove *websocket.Conn) []*websocket.Conn {
+// removeConn removes remove from conns. found is false if it had already been
+// removed, which happens when its send queue overflowed before the read loop
+// noticed the connection was gone.
+func removeConn(conns []*client, remove *client) (_ []*client, found bool) {
 	var i int
-	var found bool
 	for i = 0; i < len(conns); i++ {
 		if conns[i] == remove {
 			found = true
@@ -161,24 +366,25 @@ func removeConn(conns []*websocket.Conn, remove *websocket.Conn) []*websocket.Co
 		}
 	}
 	if !found {
-		fmt.Printf("conns: %#v\nconn: %#v\n", conns, remove)
-		panic("Conn not found")
+		return conns, false
 	}
-	copy(conns[i:], conns[i+1:]) // shift down
-	conns[len(conns)-1] = nil    // nil last element
-	return conns[:len(conns)-1]  // truncate slice
+	copy(conns[i:], conns[i+1:])      // shift down
+	conns[len(conns)-1] = nil         // nil last element
+	return conns[:len(conns)-1], true // truncate slice
 }
 
-// redisWriter publishes messages to the Redis CHANNEL
+// redisWriter publishes messages to the Redis channels of their tenants.
 type redisWriter struct {
 	pool     *redis.Pool
-	messages chan []byte
+	state    *loopState
+	messages chan delivery
 }
 
 func newRedisWriter(pool *redis.Pool) redisWriter {
 	return redisWriter{
 		pool:     pool,
-		messages: make(chan []byte, 10000),
+		state:    newLoopState(),
+		messages: make(chan delivery, cfg().PublishQueueSize),
 	}
 }
 
@@ -191,19 +397,24 @@ func (rw *redisWriter) run() error {
 	if err := conn.Err(); err != nil {
 		return errors.Wrap(err, "Redis connection error in writer")
 	}
+	rw.state.set(true, nil)
 
-	for data := range rw.messages {
-		if err := writeToRedis(conn, data); err != nil {
+	for d := range rw.messages {
+		if err := writeToRedis(conn, d.tenant.channel(), d.data); err != nil {
 			log.WithField("err", err).Error("Failed to write to Redis, will reconnect")
-			rw.publish(data) // attempt to redeliver later
+			rw.publish(d.tenant, d.data) // attempt to redeliver later
 			return err
 		}
 	}
 	return nil
 }
 
-func writeToRedis(conn redis.Conn, data []byte) error {
-	if err := conn.Send("PUBLISH", Channel, data); err != nil {
+func writeToRedis(conn redis.Conn, channel string, data []byte) (err error) {
+	defer publishLatency.observeSince(time.Now(), instance)
+	publish := tracer.start("redis.publish", extractTraceContext(data))
+	defer func() { publish.finish(err) }()
+
+	if err := conn.Send("PUBLISH", channel, data); err != nil {
 		return errors.Wrap(err, "Unable to publish message to Redis")
 	}
 	if err := conn.Flush(); err != nil {
@@ -212,7 +423,7 @@ func writeToRedis(conn redis.Conn, data []byte) error {
 	return nil
 }
 
-// publish to Redis via channel.
-func (rw *redisWriter) publish(data []byte) {
-	rw.messages <- data
+// publish to the channel of t in Redis via channel.
+func (rw *redisWriter) publish(t *tenant, data []byte) {
+	rw.messages <- delivery{tenant: t, data: data}
 }
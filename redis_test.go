@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSlowClientIsDisconnected(t *testing.T) {
+	testHub(t)
+	useConfig(t, func(c *config) { c.SendQueueSize = 1 })
+	overflows := metricValue(sendQueueOverflows, instance)
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ws, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conns <- ws
+		}
+	}))
+	defer server.Close()
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// Without a writer the queue fills up as if the client stopped reading.
+	c := newClient(<-conns, httptest.NewRequest("GET", "/ws", nil), defaultTenant, "", false)
+	rr.register(c)
+	rr.broadcast([]byte(`{"handle":"ann","text":"one"}`))
+	rr.broadcast([]byte(`{"handle":"ann","text":"two"}`))
+	waitFor(t, "the slow client to be dropped", func() bool {
+		n, _ := rr.probe(time.Second)
+		return n == 0
+	})
+	if got := metricValue(sendQueueOverflows, instance); got != overflows+1 {
+		t.Errorf("overflows = %v, want %v", got, overflows+1)
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := peer.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("peer read %v, want a policy violation close", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// configChange is a setting whose value differs between two configurations.
+// Old and New are redacted.
+type configChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// diffConfig lists the settings that differ between old and next, and the
+// keys of those that cannot be changed while running.
+func diffConfig(old, next *config) (changes []configChange, fixed []string) {
+	oldFields, nextFields := old.fields(), next.fields()
+	for i, f := range oldFields {
+		n := nextFields[i]
+		if f.String() == n.String() {
+			continue
+		}
+		changes = append(changes, configChange{Key: f.key, Old: f.redacted(), New: n.redacted()})
+		if !f.reloadable {
+			fixed = append(fixed, f.key)
+		}
+	}
+	return changes, fixed
+}
+
+// with returns a copy of c with settings, keyed by config file key, applied.
+// The copy is validated and only reloadable settings may change.
+func (c *config) with(settings map[string]string) (*config, []configChange, error) {
+	next := *c
+	fields := make(map[string]configField)
+	for _, f := range next.fields() {
+		fields[f.key] = f
+	}
+	for k, v := range settings {
+		f, ok := fields[k]
+		if !ok {
+			return nil, nil, errors.Errorf("unknown setting %q", k)
+		}
+		if err := f.set(v); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := checkReload(c, &next); err != nil {
+		return nil, nil, err
+	}
+	changes, _ := diffConfig(c, &next)
+	return &next, changes, nil
+}
+
+// checkReload returns an error if next is invalid or changes a setting that
+// requires a restart.
+func checkReload(old, next *config) error {
+	if err := next.validate(); err != nil {
+		return err
+	}
+	if _, fixed := diffConfig(old, next); len(fixed) > 0 {
+		sort.Strings(fixed)
+		return errors.Errorf("%s cannot be changed while running, restart the server to apply", strings.Join(fixed, ", "))
+	}
+	return nil
+}
+
+// configMu serializes reloads so that concurrent ones can't lose updates.
+var configMu sync.Mutex
+
+// applySettings changes the settings on this instance, logging each change.
+func applySettings(settings map[string]string) ([]configChange, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	next, changes, err := cfg().with(settings)
+	if err != nil {
+		return nil, err
+	}
+	applyConfig(next, changes)
+	return changes, nil
+}
+
+func applyConfig(next *config, changes []configChange) {
+	currentConfig.Store(next)
+	if level, err := logrus.ParseLevel(next.LogLevel); err == nil {
+		logrus.SetLevel(level)
+	}
+	for _, ch := range changes {
+		log.WithFields(logrus.Fields{"key": ch.Key, "old": ch.Old, "new": ch.New}).Info("Configuration changed")
+	}
+}
+
+// changedSettings returns the settings of next that differ from old, keyed by
+// config file key and with their real, unredacted values.
+func changedSettings(old, next *config) map[string]string {
+	settings := make(map[string]string)
+	oldFields := old.fields()
+	for i, f := range next.fields() {
+		if f.String() != oldFields[i].String() {
+			settings[f.key] = f.String()
+		}
+	}
+	return settings
+}
+
+// reloadConfig validates the settings against this instance's configuration
+// and publishes them so that every instance, this one included, applies them.
+func reloadConfig(pool *redis.Pool, settings map[string]string) ([]configChange, error) {
+	_, changes, err := cfg().with(settings)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changes, publishControl(pool, controlCommand{Op: opConfig, Settings: settings})
+}
+
+// handleReloadSignal reloads the configuration from its original sources,
+// which lets an edited config file take effect, whenever SIGHUP is received.
+// args are the flags the server was started with.
+func handleReloadSignal(pool *redis.Pool, args []string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		l := log.WithField("signal", "SIGHUP")
+		next, _, err := loadConfig("serve", args)
+		if err != nil {
+			l.WithField("err", err).Error("Not reloading configuration")
+			continue
+		}
+		if err := checkReload(cfg(), next); err != nil {
+			l.WithField("err", err).Error("Not reloading configuration")
+			continue
+		}
+		changes, err := reloadConfig(pool, changedSettings(cfg(), next))
+		if err != nil {
+			l.WithField("err", err).Error("Unable to reload configuration")
+			continue
+		}
+		l.WithField("changes", len(changes)).Info("Configuration reload published")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Room modes.
+const (
+	roomModeChat = ""
+	roomModeQA   = "qa"
+)
+
+// roomSettings configure the chat room of a tenant. A tenant has a single
+// room, carried by its channel. They are stored as JSON at the tenant's
+// "room" key.
+type roomSettings struct {
+	// Mode is empty for an open chat, or qa to turn messages into questions
+	// the audience can upvote.
+	Mode string `json:"mode,omitempty"`
+
+	// SlowModeSeconds is the minimum interval between two messages of a
+	// user, 0 for none.
+	SlowModeSeconds int `json:"slow_mode_seconds,omitempty"`
+
+	// ReadOnly rooms only carry announcements made through the admin API.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// MaxMembers caps the connections in the room, 0 for no cap. It is
+	// checked when joining.
+	MaxMembers int `json:"max_members,omitempty"`
+
+	// Private rooms only admit members, who join with an invite. Widget
+	// guests can't join.
+	Private bool `json:"private,omitempty"`
+
+	// NoGuests keeps widget guests out of the room.
+	NoGuests bool `json:"no_guests,omitempty"`
+
+	// RequireApproval holds new connections until an administrator approves
+	// them. Pending connections neither receive nor send messages.
+	RequireApproval bool `json:"require_approval,omitempty"`
+
+	// Transcript appends the messages of the room to a transcript file on
+	// every instance with a transcript directory.
+	Transcript bool `json:"transcript,omitempty"`
+}
+
+func (s roomSettings) validate() error {
+	if s.Mode != roomModeChat && s.Mode != roomModeQA {
+		return errors.Errorf("mode %q must be empty or qa", s.Mode)
+	}
+	if s.SlowModeSeconds < 0 {
+		return errors.New("slow_mode_seconds can't be negative")
+	}
+	if s.MaxMembers < 0 {
+		return errors.New("max_members can't be negative")
+	}
+	return nil
+}
+
+// full returns true if t's room has reached its member cap.
+func (s roomSettings) full(pool *redis.Pool, t *tenant) (bool, error) {
+	if s.MaxMembers <= 0 {
+		return false, nil
+	}
+	n, _, err := t.connectionCount(pool)
+	if err != nil {
+		return false, err
+	}
+	return n >= s.MaxMembers, nil
+}
+
+// allowPost enforces slow mode, returning false if user posted in t's room
+// less than SlowModeSeconds ago. The interval is tracked in Redis so that it
+// holds across instances.
+func (s roomSettings) allowPost(pool *redis.Pool, t *tenant, user string) (bool, error) {
+	if s.SlowModeSeconds <= 0 {
+		return true, nil
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	interval := time.Duration(s.SlowModeSeconds) * time.Second
+	reply, err := conn.Do("SET", t.key("slow", user), 1, "NX", "PX", int64(interval/time.Millisecond))
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to check slow mode")
+	}
+	return reply != nil, nil
+}
+
+// roomList is this instance's copy of the room settings stored in Redis, by
+// tenant.
+type roomList struct {
+	*tenantCache
+}
+
+var rooms = roomList{newTenantCache(func(pool *redis.Pool, t *tenant) (interface{}, error) {
+	return loadRoom(pool, t)
+})}
+
+// get returns the settings of t's room.
+func (l roomList) get(t *tenant) roomSettings {
+	s, _ := l.value(t).(roomSettings)
+	return s
+}
+
+func loadRoom(pool *redis.Pool, t *tenant) (roomSettings, error) {
+	var s roomSettings
+	conn := pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", t.key("room")))
+	if err == redis.ErrNil {
+		return s, nil
+	}
+	if err != nil {
+		return s, errors.Wrap(err, "Unable to read room settings")
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, errors.Wrap(err, "Unmarshaling room settings")
+	}
+	return s, nil
+}
+
+// saveRoom changes the settings of t's room across the cluster.
+func saveRoom(pool *redis.Pool, t *tenant, s roomSettings) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "Marshaling room settings")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", t.key("room"), data); err != nil {
+		return errors.Wrap(err, "Unable to save room settings")
+	}
+	return publishControl(pool, controlCommand{Op: opRoomChanged, Tenant: t.ID})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Snippets are messages carrying code or logs. The server detects their
+// language when the client gives no hint, highlights them and stores the raw
+// text for snippetTTL at the tenant's snippet:ID key, where the raw and
+// download endpoints read it. Snippets longer than the collapse threshold are
+// sent with only their first lines highlighted.
+
+var validSnippetID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// snippetFrame is the frame sent to clients for a snippet.
+type snippetFrame struct {
+	Type        string    `json:"type"`
+	ID          string    `json:"id"`
+	Handle      string    `json:"handle"`
+	Language    string    `json:"lang"`
+	HTML        string    `json:"html"`
+	Lines       int       `json:"lines"`
+	Collapsed   bool      `json:"collapsed,omitempty"`
+	Size        int       `json:"size"`
+	RawURL      string    `json:"raw_url"`
+	DownloadURL string    `json:"download_url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// snippet is a snippet as stored in Redis.
+type snippet struct {
+	Handle    string    `json:"handle"`
+	Language  string    `json:"lang"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// handleSnippet stores and highlights a snippet message and publishes it to
+// every connection of t.
+func handleSnippet(pool *redis.Pool, t *tenant, msg message) error {
+	language := normalizeLanguage(msg.Language)
+	if language == "" {
+		language = detectLanguage(msg.Text)
+	}
+	s := snippet{Handle: msg.Handle, Language: language, Text: msg.Text, CreatedAt: time.Now()}
+	id := newID()
+	if err := saveSnippet(pool, t, id, s); err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimRight(s.Text, "\n"), "\n")
+	shown := s.Text
+	collapsed := len(lines) > cfg().SnippetCollapseLines
+	if collapsed {
+		shown = strings.Join(lines[:cfg().SnippetCollapseLines], "\n")
+	}
+	data, err := json.Marshal(snippetFrame{
+		Type:        messageSnippet,
+		ID:          id,
+		Handle:      s.Handle,
+		Language:    language,
+		HTML:        highlight(shown, language),
+		Lines:       len(lines),
+		Collapsed:   collapsed,
+		Size:        len(s.Text),
+		RawURL:      "/snippets/" + id + "/raw",
+		DownloadURL: "/snippets/" + id + "/download",
+		CreatedAt:   s.CreatedAt,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Marshaling snippet")
+	}
+	rw.publish(t, data)
+	return nil
+}
+
+func saveSnippet(pool *redis.Pool, t *tenant, id string, s snippet) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "Marshaling snippet")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	ttl := cfg().SnippetTTL
+	if err := t.reserveStorage(conn, "snippet:"+id, len(data), ttl); err != nil {
+		return err
+	}
+	if _, err := conn.Do("SET", t.key("snippet", id), data, "EX", int64(ttl/time.Second)); err != nil {
+		return errors.Wrap(err, "Unable to save snippet")
+	}
+	return nil
+}
+
+// getSnippet returns the snippet of t with the provided id, or nil if there
+// is none or it has expired.
+func getSnippet(pool *redis.Pool, t *tenant, id string) (*snippet, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", t.key("snippet", id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read snippet")
+	}
+	var s snippet
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.Wrapf(err, "Unmarshaling snippet %s", id)
+	}
+	return &s, nil
+}
+
+// handleSnippetFile serves the raw text of a snippet at /snippets/ID/raw, or
+// as a file download at /snippets/ID/download, to the readers readerTenant
+// accepts.
+func handleSnippetFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/snippets/"), "/")
+	if len(parts) != 2 || !validSnippetID.MatchString(parts[0]) || (parts[1] != "raw" && parts[1] != "download") {
+		http.NotFound(w, r)
+		return
+	}
+	t := readerTenant(w, r)
+	if t == nil {
+		return
+	}
+	s, err := getSnippet(rr.pool, t, parts[0])
+	if err != nil {
+		log.WithField("err", err).Error("Unable to read snippet")
+		http.Error(w, "Unable to read snippet", http.StatusBadGateway)
+		return
+	}
+	if s == nil {
+		http.Error(w, "Unknown snippet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	if parts[1] == "download" {
+		w.Header().Set("Content-Disposition", `attachment; filename="snippet-`+parts[0]+"."+languageExtensions[s.Language]+`"`)
+	}
+	w.Write([]byte(s.Text))
+}
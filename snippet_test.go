@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnippetFileForWidgetGuest(t *testing.T) {
+	_, pool := testHub(t)
+	acme := &tenant{ID: "acme"}
+	useTenants(t, acme)
+	useConfig(t, func(c *config) { c.WidgetSecret = "secret" })
+	if err := saveSite(pool, &site{Key: "site", Tenant: "acme", Origins: []string{"https://example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSnippet(pool, acme, "0123456789abcdef", snippet{Handle: "ann", Language: "go", Text: "package main"}); err != nil {
+		t.Fatal(err)
+	}
+	token, err := signGuestToken(guestClaims{Site: "site", Tenant: "acme", Handle: "guest-1", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := signGuestToken(guestClaims{Site: "site", Tenant: "acme", Handle: "guest-1", Expires: time.Now().Add(-time.Hour).Unix()})
+
+	tests := []struct {
+		url, origin string
+		want        int
+		cors        string
+	}{
+		{"/snippets/0123456789abcdef/raw", "", http.StatusNotFound, ""},
+		{"/snippets/0123456789abcdef/raw?widget_token=" + token, "", http.StatusOK, ""},
+		{"/snippets/0123456789abcdef/download?widget_token=" + token, "https://example.com", http.StatusOK, "https://example.com"},
+		{"/snippets/0123456789abcdef/raw?widget_token=" + token, "https://evil.example.com", http.StatusOK, ""},
+		{"/snippets/0123456789abcdef/raw?widget_token=" + expired, "", http.StatusForbidden, ""},
+		{"/snippets/0123456789abcdef/raw?widget_token=forged", "", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		handleSnippetFile(w, r)
+		if w.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.url, w.Code, tt.want)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.cors {
+			t.Errorf("GET %s from %q allows %q", tt.url, tt.origin, got)
+		}
+		if tt.want == http.StatusOK && w.Body.String() != "package main" {
+			t.Errorf("GET %s = %q", tt.url, w.Body.String())
+		}
+	}
+}
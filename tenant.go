@@ -0,0 +1,543 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// tenantsKey is the Redis hash holding every tenant's settings, keyed by ID.
+var tenantsKey = redisKey("tenants")
+
+// tenantPattern matches the pubsub channels of every tenant but the default.
+var tenantPattern = redisKey("tenant", "*")
+
+var validTenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// defaultTenantName stands for the default tenant in logs, the CLI and
+// transcript directories, so no other tenant may use it as its ID.
+const defaultTenantName = "default"
+
+// isTenantID returns true if id may be used by a tenant other than the
+// default one.
+func isTenantID(id string) bool {
+	return id != defaultTenantName && validTenantID.MatchString(id)
+}
+
+// tenant is a team sharing the deployment. Every Redis key and channel used on
+// behalf of a tenant is built by its key method, which keeps tenants from
+// seeing each other's data. The default tenant has an empty ID and uses the
+// original, unprefixed namespace so that single-tenant deployments are
+// unaffected.
+type tenant struct {
+	ID string `json:"id"`
+
+	// Token selects the tenant for clients that can't use its subdomain.
+	Token string `json:"token,omitempty"`
+
+	// AdminToken grants access to the tenant's part of the admin surface.
+	AdminToken string `json:"admin_token,omitempty"`
+
+	// Quotas, zero meaning unlimited.
+	MaxConnections    int `json:"max_connections,omitempty"`
+	MessagesPerMinute int `json:"messages_per_minute,omitempty"`
+
+	// MaxGuests caps the widget guests connected across the cluster,
+	// separately from MaxConnections.
+	MaxGuests int `json:"max_guests,omitempty"`
+
+	// MaxStorageBytes caps what the tenant stores in Redis: snippets,
+	// custom emoji and Q&A questions.
+	MaxStorageBytes int `json:"max_storage_bytes,omitempty"`
+}
+
+var defaultTenant = &tenant{}
+
+// key builds a Redis key or channel name in the tenant's namespace.
+func (t *tenant) key(parts ...string) string {
+	if t.ID == "" {
+		return redisKey(parts...)
+	}
+	return redisKey(append([]string{"tenant", t.ID}, parts...)...)
+}
+
+// channel is the pubsub channel carrying the tenant's chat messages.
+func (t *tenant) channel() string {
+	return t.key()
+}
+
+// name is the tenant's ID, or "default" for the default tenant.
+func (t *tenant) name() string {
+	if t.ID == "" {
+		return defaultTenantName
+	}
+	return t.ID
+}
+
+// tenantFromChannel returns the ID of the tenant a chat channel belongs to.
+// ok is false if channel isn't a tenant's chat channel.
+func tenantFromChannel(channel string) (id string, ok bool) {
+	if channel == defaultTenant.channel() {
+		return "", true
+	}
+	prefix := redisKey("tenant") + ":"
+	if !strings.HasPrefix(channel, prefix) {
+		return "", false
+	}
+	id = strings.TrimPrefix(channel, prefix)
+	return id, isTenantID(id)
+}
+
+// tenantList is this instance's copy of the tenants stored in Redis. It is
+// loaded before the per-tenant caches, whenever the receiver (re)connects and
+// when a tenant changes anywhere in the cluster.
+type tenantList struct {
+	mu      sync.RWMutex
+	tenants map[string]*tenant
+}
+
+var tenants = &tenantList{tenants: make(map[string]*tenant)}
+
+// load replaces the cached tenants with the ones stored in Redis.
+func (l *tenantList) load(pool *redis.Pool) error {
+	list, err := listTenants(pool)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]*tenant, len(list))
+	for _, t := range list {
+		m[t.ID] = t
+	}
+	l.mu.Lock()
+	l.tenants = m
+	l.mu.Unlock()
+	return nil
+}
+
+// get returns the tenant with the provided ID, the default tenant if id is
+// empty, or nil if there is no such tenant.
+func (l *tenantList) get(id string) *tenant {
+	if id == "" {
+		return defaultTenant
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tenants[id]
+}
+
+// all returns the default tenant followed by every other tenant.
+func (l *tenantList) all() []*tenant {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	all := []*tenant{defaultTenant}
+	for _, t := range l.tenants {
+		all = append(all, t)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+// byToken returns the tenant whose token, or admin token if admin is true,
+// is token.
+func (l *tenantList) byToken(token string, admin bool) *tenant {
+	if token == "" {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, t := range l.tenants {
+		want := t.Token
+		if admin {
+			want = t.AdminToken
+		}
+		if want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// resolve identifies the tenant a websocket request is for, from the
+// tenant_token query parameter or X-Tenant-Token header, or else from the
+// subdomain of the request. Requests matching neither belong to the default
+// tenant. ok is false if a token was provided but doesn't match any tenant.
+func (l *tenantList) resolve(r *http.Request) (t *tenant, ok bool) {
+	token := r.URL.Query().Get("tenant_token")
+	if token == "" {
+		token = r.Header.Get("X-Tenant-Token")
+	}
+	if token != "" {
+		t := l.byToken(token, false)
+		return t, t != nil
+	}
+	host := r.Host
+	if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+		host = host[:i]
+	}
+	if labels := strings.Split(host, "."); len(labels) > 2 {
+		if t := l.get(strings.ToLower(labels[0])); t != nil {
+			return t, true
+		}
+	}
+	return defaultTenant, true
+}
+
+// kickRemoved disconnects the connections on this instance whose tenant has
+// been removed.
+func (l *tenantList) kickRemoved() {
+	for _, c := range rr.clients() {
+		if l.get(c.Tenant) == nil {
+			rr.kick(c.Tenant, c.ID)
+		}
+	}
+}
+
+// tenantCache is this instance's copy of a piece of per-tenant data stored
+// in Redis, such as the bans or the room settings. It is reloaded whenever
+// the receiver (re)connects and when the data changes anywhere in the
+// cluster.
+type tenantCache struct {
+	read func(pool *redis.Pool, t *tenant) (interface{}, error)
+
+	mu      sync.RWMutex
+	entries map[string]interface{}
+}
+
+// newTenantCache returns an empty cache whose entries are read with read.
+func newTenantCache(read func(pool *redis.Pool, t *tenant) (interface{}, error)) *tenantCache {
+	return &tenantCache{read: read, entries: make(map[string]interface{})}
+}
+
+// load replaces the cached entry of t with the one stored in Redis.
+func (c *tenantCache) load(pool *redis.Pool, t *tenant) error {
+	v, err := c.read(pool, t)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.entries[t.ID] = v
+	c.mu.Unlock()
+	return nil
+}
+
+// loadAll reloads the entries of every tenant, dropping those of tenants
+// that no longer exist. The cache is only replaced once every tenant's entry
+// has been read, so that the old entries keep applying while they are
+// reloaded or if reading them fails.
+func (c *tenantCache) loadAll(pool *redis.Pool) error {
+	all := make(map[string]interface{})
+	for _, t := range tenants.all() {
+		v, err := c.read(pool, t)
+		if err != nil {
+			return err
+		}
+		all[t.ID] = v
+	}
+	c.mu.Lock()
+	c.entries = all
+	c.mu.Unlock()
+	return nil
+}
+
+// value returns the cached entry of t, nil if there is none.
+func (c *tenantCache) value(t *tenant) interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries[t.ID]
+}
+
+// allowConnection checks the tenant's connection quota.
+func (t *tenant) allowConnection(pool *redis.Pool) (bool, error) {
+	if t.MaxConnections <= 0 {
+		return true, nil
+	}
+	n, _, err := t.connectionCount(pool)
+	if err != nil {
+		return false, err
+	}
+	return n < t.MaxConnections, nil
+}
+
+// allowGuest checks the tenant's guest quota.
+func (t *tenant) allowGuest(pool *redis.Pool) (bool, error) {
+	if t.MaxGuests <= 0 {
+		return true, nil
+	}
+	_, guests, err := t.connectionCount(pool)
+	if err != nil {
+		return false, err
+	}
+	return guests < t.MaxGuests, nil
+}
+
+// connectionCount counts the tenant's connections, and the guests among them,
+// recorded in the registry by the other instances and the ones on this
+// instance. As the registry is updated periodically the count is approximate.
+func (t *tenant) connectionCount(pool *redis.Pool) (conns, guests int, err error) {
+	cluster, err := clusterClients(pool, t)
+	if err != nil {
+		return 0, 0, err
+	}
+	count := func(c clientInfo) {
+		conns++
+		if c.Guest {
+			guests++
+		}
+	}
+	for _, c := range cluster {
+		if c.Instance != instance {
+			count(c)
+		}
+	}
+	for _, c := range rr.clients() {
+		if c.Tenant == t.ID {
+			count(c)
+		}
+	}
+	return conns, guests, nil
+}
+
+// allowMessage counts a message against the tenant's per minute quota, shared
+// by every instance, and returns false if the quota has been used up. The
+// quota is read from the latest copy of the tenant so that changes apply to
+// connections that are already open.
+func (t *tenant) allowMessage(pool *redis.Pool) (bool, error) {
+	if latest := tenants.get(t.ID); latest != nil {
+		t = latest
+	}
+	if t.MessagesPerMinute <= 0 {
+		return true, nil
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	key := t.key("rate", strconv.FormatInt(time.Now().Unix()/60, 10))
+	conn.Send("MULTI")
+	conn.Send("INCR", key)
+	conn.Send("EXPIRE", key, 120)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to count message against quota")
+	}
+	n, err := redis.Int(replies[0], nil)
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to count message against quota")
+	}
+	return n <= t.MessagesPerMinute, nil
+}
+
+// errStorageQuota is returned when storing something would exceed the
+// tenant's storage quota.
+var errStorageQuota = errors.New("storage quota exceeded")
+
+// reserveStorage records that item, stored on behalf of t, takes n bytes
+// until it expires after ttl, or for good if ttl is 0. It returns
+// errStorageQuota, recording nothing, if this would take the tenant over its
+// quota. Usage is kept in the tenant's "storage" hash, of item to size and
+// expiry, so that it is counted in the same way for every kind of item and
+// on every instance. Concurrent reservations may overshoot the quota
+// slightly, like the connection quota.
+func (t *tenant) reserveStorage(conn redis.Conn, item string, n int, ttl time.Duration) error {
+	if latest := tenants.get(t.ID); latest != nil {
+		t = latest
+	}
+	if t.MaxStorageBytes > 0 {
+		used, err := t.storageUsed(conn, item)
+		if err != nil {
+			return err
+		}
+		if used+n > t.MaxStorageBytes {
+			return errStorageQuota
+		}
+	}
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Unix()
+	}
+	if _, err := conn.Do("HSET", t.key("storage"), item, fmt.Sprintf("%d %d", n, expires)); err != nil {
+		return errors.Wrap(err, "Unable to record storage")
+	}
+	return nil
+}
+
+// releaseStorage forgets the size of items that have been removed.
+func (t *tenant) releaseStorage(conn redis.Conn, items ...string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if _, err := conn.Do("HDEL", redis.Args{}.Add(t.key("storage")).AddFlat(items)...); err != nil {
+		return errors.Wrap(err, "Unable to release storage")
+	}
+	return nil
+}
+
+// storageUsed returns the bytes stored by t, leaving out except, which is
+// about to be replaced. Expired items are forgotten on the way.
+func (t *tenant) storageUsed(conn redis.Conn, except string) (int, error) {
+	values, err := redis.StringMap(conn.Do("HGETALL", t.key("storage")))
+	if err != nil {
+		return 0, errors.Wrap(err, "Unable to read storage usage")
+	}
+	now := time.Now().Unix()
+	used := 0
+	var expired []string
+	for item, v := range values {
+		var n int
+		var expires int64
+		fmt.Sscan(v, &n, &expires)
+		switch {
+		case expires > 0 && expires <= now:
+			expired = append(expired, item)
+		case item != except:
+			used += n
+		}
+	}
+	if err := t.releaseStorage(conn, expired...); err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+func listTenants(pool *redis.Pool) ([]*tenant, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", tenantsKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list tenants")
+	}
+	list := make([]*tenant, 0, len(values))
+	for id, data := range values {
+		var t tenant
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			return nil, errors.Wrapf(err, "Unmarshaling tenant %s", id)
+		}
+		list = append(list, &t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// loadTenant returns the stored tenant with the provided ID, or nil if there
+// is none.
+func loadTenant(pool *redis.Pool, id string) (*tenant, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("HGET", tenantsKey, id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read tenant")
+	}
+	var t tenant
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, errors.Wrapf(err, "Unmarshaling tenant %s", id)
+	}
+	return &t, nil
+}
+
+func (t *tenant) validate() error {
+	if t.ID == defaultTenantName {
+		return errors.Errorf("tenant id %q is reserved for the default tenant", t.ID)
+	}
+	if !isTenantID(t.ID) {
+		return errors.Errorf("invalid tenant id %q: use lower case letters, digits and dashes", t.ID)
+	}
+	if t.MaxConnections < 0 || t.MaxGuests < 0 || t.MessagesPerMinute < 0 || t.MaxStorageBytes < 0 {
+		return errors.New("quotas must not be negative")
+	}
+	return nil
+}
+
+// saveTenant creates or updates a tenant across the cluster. Missing tokens
+// are kept from the existing tenant, if any, or generated.
+func saveTenant(pool *redis.Pool, t *tenant) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	existing, err := loadTenant(pool, t.ID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		existing = &tenant{}
+	}
+	if t.Token == "" {
+		t.Token = existing.Token
+	}
+	if t.Token == "" {
+		t.Token = newToken()
+	}
+	if t.AdminToken == "" {
+		t.AdminToken = existing.AdminToken
+	}
+	if t.AdminToken == "" {
+		t.AdminToken = newToken()
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return errors.Wrap(err, "Marshaling tenant")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", tenantsKey, t.ID, data); err != nil {
+		return errors.Wrap(err, "Unable to save tenant")
+	}
+	return publishControl(pool, controlCommand{Op: opTenantsChanged})
+}
+
+// removeTenant removes a tenant, every key in its namespace and its sites, and
+// disconnects its connections.
+func removeTenant(pool *redis.Pool, id string) error {
+	if !isTenantID(id) {
+		return errors.Errorf("invalid tenant id %q", id)
+	}
+	t := &tenant{ID: id}
+	conn := pool.Get()
+	defer conn.Close()
+	removed, err := redis.Int(conn.Do("HDEL", tenantsKey, id))
+	if err != nil {
+		return errors.Wrap(err, "Unable to remove tenant")
+	}
+	if removed == 0 {
+		return errors.Errorf("no tenant %q", id)
+	}
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", t.key("*")))
+		if err != nil {
+			return errors.Wrap(err, "Unable to list tenant keys")
+		}
+		var keys []interface{}
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return errors.Wrap(err, "Unable to list tenant keys")
+		}
+		if len(keys) > 0 {
+			if _, err := conn.Do("DEL", keys...); err != nil {
+				return errors.Wrap(err, "Unable to remove tenant keys")
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	sites, err := listSites(pool, []*tenant{t})
+	if err != nil {
+		return err
+	}
+	for _, s := range sites {
+		if err := removeSite(pool, s.Key); err != nil {
+			return err
+		}
+	}
+	return publishControl(pool, controlCommand{Op: opTenantsChanged})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// useTenants replaces the cached tenants with list for the duration of the
+// test.
+func useTenants(t *testing.T, list ...*tenant) {
+	saved := tenants
+	tenants = &tenantList{tenants: make(map[string]*tenant)}
+	for _, tn := range list {
+		tenants.tenants[tn.ID] = tn
+	}
+	t.Cleanup(func() { tenants = saved })
+}
+
+func TestTenantKey(t *testing.T) {
+	tests := []struct {
+		tenant *tenant
+		parts  []string
+		want   string
+	}{
+		{defaultTenant, nil, "chat"},
+		{defaultTenant, []string{"bans"}, "chat:bans"},
+		{defaultTenant, []string{"qa", "voters", "1"}, "chat:qa:voters:1"},
+		{&tenant{ID: "acme"}, nil, "chat:tenant:acme"},
+		{&tenant{ID: "acme"}, []string{"bans"}, "chat:tenant:acme:bans"},
+		{&tenant{ID: "acme"}, []string{"snippet", "ab"}, "chat:tenant:acme:snippet:ab"},
+	}
+	for _, tt := range tests {
+		if got := tt.tenant.key(tt.parts...); got != tt.want {
+			t.Errorf("%q.key(%q) = %q, want %q", tt.tenant.ID, tt.parts, got, tt.want)
+		}
+	}
+}
+
+func TestTenantFromChannel(t *testing.T) {
+	tests := []struct {
+		channel string
+		id      string
+		ok      bool
+	}{
+		{"chat", "", true},
+		{"chat:tenant:acme", "acme", true},
+		{"chat:tenant:a-1", "a-1", true},
+		{"chat:tenant:default", "default", false},
+		{"chat:tenant:Acme", "Acme", false},
+		{"chat:tenant:acme:bans", "acme:bans", false},
+		{"chat:tenant:", "", false},
+		{"chat:control", "", false},
+		{"other", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := tenantFromChannel(tt.channel)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("tenantFromChannel(%q) = %q, %v, want %q, %v", tt.channel, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+func TestTenantValidate(t *testing.T) {
+	for _, id := range []string{"", "default", "Acme", "-acme", "acme:x", strings.Repeat("a", 64)} {
+		if err := (&tenant{ID: id}).validate(); err == nil {
+			t.Errorf("tenant %q is valid", id)
+		}
+	}
+	if err := (&tenant{ID: "acme", MaxStorageBytes: -1}).validate(); err == nil {
+		t.Error("negative storage quota is valid")
+	}
+	if err := (&tenant{ID: "acme-2"}).validate(); err != nil {
+		t.Errorf("tenant acme-2 is invalid: %v", err)
+	}
+}
+
+func TestTenantsResolve(t *testing.T) {
+	acme := &tenant{ID: "acme", Token: "acme-token", AdminToken: "acme-admin"}
+	globex := &tenant{ID: "globex", Token: "globex-token"}
+	useTenants(t, acme, globex)
+
+	tests := []struct {
+		url    string
+		header string
+		want   *tenant
+		ok     bool
+	}{
+		{"http://chat.example.com/ws", "", defaultTenant, true},
+		{"http://localhost:8080/ws", "", defaultTenant, true},
+		{"http://acme.chat.example.com/ws", "", acme, true},
+		{"http://ACME.chat.example.com:8080/ws", "", acme, true},
+		{"http://unknown.chat.example.com/ws", "", defaultTenant, true},
+		{"http://chat.example.com/ws?tenant_token=globex-token", "", globex, true},
+		{"http://acme.chat.example.com/ws?tenant_token=globex-token", "", globex, true},
+		{"http://chat.example.com/ws", "acme-token", acme, true},
+		{"http://chat.example.com/ws?tenant_token=wrong", "", nil, false},
+		{"http://chat.example.com/ws?tenant_token=acme-admin", "", nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("X-Tenant-Token", tt.header)
+		}
+		got, ok := tenants.resolve(r)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("resolve(%s, %q) = %v, %v, want %v, %v", tt.url, tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestTenantIsolation writes every kind of tenant data for one tenant and
+// checks that it can't be seen from another.
+func TestTenantIsolation(t *testing.T) {
+	fake, pool := testHub(t)
+	a := &tenant{ID: "acme"}
+	b := &tenant{ID: "globex"}
+	useTenants(t, a, b)
+	if err := saveTenant(pool, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveTenant(pool, b); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("bans", func(t *testing.T) {
+		if err := addBan(pool, a, "mallory"); err != nil {
+			t.Fatal(err)
+		}
+		if err := bans.loadAll(pool); err != nil {
+			t.Fatal(err)
+		}
+		if !bans.banned(a, "mallory", "") {
+			t.Error("ban missing from its tenant")
+		}
+		if bans.banned(b, "mallory", "") || bans.banned(defaultTenant, "mallory", "") {
+			t.Error("ban applies to another tenant")
+		}
+		if list, _ := listBans(pool, b); len(list) != 0 {
+			t.Errorf("other tenant lists bans %q", list)
+		}
+	})
+
+	t.Run("room settings", func(t *testing.T) {
+		if err := saveRoom(pool, a, roomSettings{ReadOnly: true, Mode: roomModeQA}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rooms.loadAll(pool); err != nil {
+			t.Fatal(err)
+		}
+		if s := rooms.get(a); !s.ReadOnly {
+			t.Error("settings missing from their tenant")
+		}
+		if s := rooms.get(b); s != (roomSettings{}) {
+			t.Errorf("other tenant has settings %+v", s)
+		}
+		if s, _ := loadRoom(pool, defaultTenant); s != (roomSettings{}) {
+			t.Errorf("default tenant has settings %+v", s)
+		}
+	})
+
+	t.Run("questions", func(t *testing.T) {
+		if err := askQuestion(pool, a, "ann", "When is the launch?", "v1"); err != nil {
+			t.Fatal(err)
+		}
+		qs, err := listQuestions(pool, a)
+		if err != nil || len(qs) != 1 {
+			t.Fatalf("listQuestions = %v, %v", qs, err)
+		}
+		if other, _ := listQuestions(pool, b); len(other) != 0 {
+			t.Errorf("other tenant lists questions %v", other)
+		}
+		if err := upvoteQuestion(pool, b, qs[0].ID, "v2"); err == nil {
+			t.Error("upvoted another tenant's question")
+		}
+		if q, _ := setQuestionStatus(pool, b, qs[0].ID, questionAnswered); q != nil {
+			t.Error("answered another tenant's question")
+		}
+		// The same text asked in another tenant is a new question.
+		if err := askQuestion(pool, b, "bob", "When is the launch?", "v1"); err != nil {
+			t.Fatal(err)
+		}
+		if other, _ := listQuestions(pool, b); len(other) != 1 || other[0].ID == qs[0].ID {
+			t.Errorf("other tenant's questions are %v", other)
+		}
+	})
+
+	t.Run("snippets", func(t *testing.T) {
+		s := snippet{Handle: "ann", Language: "go", Text: "package main", CreatedAt: time.Now()}
+		if err := saveSnippet(pool, a, "0123456789abcdef", s); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := getSnippet(pool, a, "0123456789abcdef"); got == nil || got.Text != s.Text {
+			t.Errorf("getSnippet = %+v", got)
+		}
+		if got, _ := getSnippet(pool, b, "0123456789abcdef"); got != nil {
+			t.Error("other tenant reads the snippet")
+		}
+	})
+
+	t.Run("emoji", func(t *testing.T) {
+		if _, err := saveEmoji(pool, a, "acme_logo", testPNG(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := customEmojis.loadAll(pool); err != nil {
+			t.Fatal(err)
+		}
+		if _, used := expandShortcodes(a, ":acme_logo:"); used["acme_logo"] == "" {
+			t.Error("emoji missing from its tenant")
+		}
+		if _, used := expandShortcodes(b, ":acme_logo:"); used != nil {
+			t.Errorf("other tenant expands %v", used)
+		}
+		if list, _ := listEmoji(pool, b); len(list) != 0 {
+			t.Errorf("other tenant lists emoji %v", list)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		var before []string
+		for _, k := range fake.keys() {
+			if !strings.HasPrefix(k, a.key()+":") {
+				before = append(before, k)
+			}
+		}
+		if err := removeTenant(pool, a.ID); err != nil {
+			t.Fatal(err)
+		}
+		after := fake.keys()
+		for _, k := range after {
+			if strings.HasPrefix(k, a.key()+":") {
+				t.Errorf("key %s of the removed tenant is left", k)
+			}
+		}
+		if strings.Join(after, " ") != strings.Join(before, " ") {
+			t.Errorf("keys of other tenants changed from %q to %q", before, after)
+		}
+		if list, _ := listTenants(pool); len(list) != 1 || list[0].ID != b.ID {
+			t.Errorf("tenants left are %v", list)
+		}
+	})
+}
+
+func TestStorageQuota(t *testing.T) {
+	_, pool := testHub(t)
+	a := &tenant{ID: "acme", MaxStorageBytes: 200}
+	b := &tenant{ID: "globex", MaxStorageBytes: 200}
+	useTenants(t, a, b)
+
+	s := snippet{Handle: "ann", Text: strings.Repeat("x", 100)}
+	if err := saveSnippet(pool, a, "0000000000000001", s); err != nil {
+		t.Fatal(err)
+	}
+	err := saveSnippet(pool, a, "0000000000000002", s)
+	if errors.Cause(err) != errStorageQuota {
+		t.Fatalf("second snippet: err = %v, want the storage quota", err)
+	}
+	if got, _ := getSnippet(pool, a, "0000000000000002"); got != nil {
+		t.Error("snippet over the quota was stored")
+	}
+	if err := askQuestion(pool, a, "ann", strings.Repeat("why ", 20), "v1"); errors.Cause(err) != errStorageQuota {
+		t.Errorf("question: err = %v, want the storage quota", err)
+	}
+	if _, err := saveEmoji(pool, a, "acme_logo", testPNG(t)); errors.Cause(err) != errStorageQuota {
+		t.Errorf("emoji: err = %v, want the storage quota", err)
+	}
+
+	// Other tenants have their own quota.
+	if err := saveSnippet(pool, b, "0000000000000002", s); err != nil {
+		t.Errorf("other tenant: %v", err)
+	}
+
+	// Raising the quota applies right away.
+	a.MaxStorageBytes = 0
+	if err := saveSnippet(pool, a, "0000000000000002", s); err != nil {
+		t.Errorf("unlimited: %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// traceparentField is the message field used to carry the W3C trace
+	// context through the writer queue and Redis.
+	traceparentField = "traceparent"
+
+	spanBatchSize     = 512
+	spanQueueSize     = 4096
+	spanFlushInterval = 5 * time.Second
+)
+
+// spanContext identifies a span within a trace.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// traceparent formats the context as a W3C traceparent header value.
+func (sc spanContext) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.traceID[:]), hex.EncodeToString(sc.spanID[:]))
+}
+
+// parseTraceparent parses a W3C traceparent value. An invalid value results in
+// an invalid (zero) spanContext so that a new trace is started.
+func parseTraceparent(s string) spanContext {
+	var sc spanContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc
+	}
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return spanContext{}
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return spanContext{}
+	}
+	copy(sc.traceID[:], tid)
+	copy(sc.spanID[:], sid)
+	return sc
+}
+
+// span is a single timed operation. A nil *span is valid and does nothing,
+// which is what the tracer hands out when tracing is disabled.
+type span struct {
+	name   string
+	ctx    spanContext
+	parent spanContext
+	start  time.Time
+	end    time.Time
+	attrs  map[string]string
+	err    error
+}
+
+// context returns the span's context for use as a parent.
+func (s *span) context() spanContext {
+	if s == nil {
+		return spanContext{}
+	}
+	return s.ctx
+}
+
+// setAttr records a string attribute on the span.
+func (s *span) setAttr(k, v string) {
+	if s == nil {
+		return
+	}
+	s.attrs[k] = v
+}
+
+// finish ends the span, recording err if it is not nil, and hands it to the
+// exporter.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	tracer.queue(s)
+}
+
+// spanExporter sends batches of finished spans somewhere.
+type spanExporter interface {
+	export(batch []*span) error
+}
+
+// spanTracer creates spans and batches finished ones to its exporter.
+type spanTracer struct {
+	exporter spanExporter
+	spans    chan *span
+}
+
+// newSpanTracer returns a disabled tracer. It is enabled by configure.
+func newSpanTracer() *spanTracer {
+	return &spanTracer{
+		spans: make(chan *span, spanQueueSize),
+	}
+}
+
+// configure the OTLP/HTTP endpoint spans are exported to. Tracing stays
+// disabled if no endpoint is configured. It must be called before run.
+func (t *spanTracer) configure(c *config) {
+	endpoint := c.OTLPTracesEndpoint
+	if endpoint == "" && c.OTLPEndpoint != "" {
+		endpoint = strings.TrimSuffix(c.OTLPEndpoint, "/") + "/v1/traces"
+	}
+	t.exporter = nil
+	if endpoint != "" {
+		t.exporter = newOTLPExporter(endpoint, c.ServiceName)
+	}
+}
+
+func (t *spanTracer) enabled() bool {
+	return t.exporter != nil
+}
+
+// start a span named name. If parent is valid the span joins its trace,
+// otherwise a new trace is started.
+func (t *spanTracer) start(name string, parent spanContext) *span {
+	if !t.enabled() {
+		return nil
+	}
+	s := &span{
+		name:   name,
+		parent: parent,
+		start:  time.Now(),
+		attrs:  map[string]string{"instance": instance},
+	}
+	if parent.valid() {
+		s.ctx.traceID = parent.traceID
+	} else {
+		rand.Read(s.ctx.traceID[:])
+	}
+	rand.Read(s.ctx.spanID[:])
+	return s
+}
+
+// queue a finished span for export. Spans are dropped rather than blocking
+// the message path when the queue is full.
+func (t *spanTracer) queue(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+		droppedSpans.inc(instance)
+	}
+}
+
+// run batches queued spans and hands them to the exporter.
+func (t *spanTracer) run() {
+	if !t.enabled() {
+		return
+	}
+	l := log.WithField("exporter", t.exporter)
+	l.Info("Exporting trace spans")
+
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, spanBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.export(batch); err != nil {
+			l.WithFields(logrus.Fields{"err": err, "spans": len(batch)}).Error("Unable to export trace spans")
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// otlpExporter posts spans to an OTLP/HTTP collector as JSON.
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+func newOTLPExporter(endpoint, service string) *otlpExporter {
+	return &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *otlpExporter) String() string {
+	return e.endpoint
+}
+
+// OTLP/JSON representation of an ExportTraceServiceRequest. Only the fields
+// this server populates are defined.
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(k, v string) otlpKeyValue {
+	kv := otlpKeyValue{Key: k}
+	kv.Value.StringValue = v
+	return kv
+}
+
+func (e *otlpExporter) export(batch []*span) error {
+	var ss otlpScopeSpans
+	ss.Scope.Name = "chat"
+	for _, s := range batch {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.traceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.spanID[:]),
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent.valid() {
+			out.ParentSpanID = hex.EncodeToString(s.parent.spanID[:])
+		}
+		for k, v := range s.attrs {
+			out.Attributes = append(out.Attributes, otlpAttr(k, v))
+		}
+		if s.err != nil {
+			out.Status.Code = 2 // STATUS_CODE_ERROR
+			out.Status.Message = s.err.Error()
+		}
+		ss.Spans = append(ss.Spans, out)
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpKeyValue{otlpAttr("service.name", e.service)}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+	if err != nil {
+		return errors.Wrap(err, "Marshaling spans")
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Posting spans")
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("Collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// injectTraceContext adds sc to the JSON message in data so that it travels
+// with the message through Redis. data is returned unchanged if sc is not
+// valid or data isn't a JSON object.
+func injectTraceContext(data []byte, sc spanContext) []byte {
+	if !sc.valid() {
+		return data
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	tp, _ := json.Marshal(sc.traceparent())
+	fields[traceparentField] = tp
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// extractTraceContext returns the trace context carried by the JSON message in
+// data, if any.
+func extractTraceContext(data []byte) spanContext {
+	if !tracer.enabled() {
+		return spanContext{}
+	}
+	var carrier struct {
+		Traceparent string `json:"traceparent"`
+	}
+	if err := json.Unmarshal(data, &carrier); err != nil {
+		return spanContext{}
+	}
+	return parseTraceparent(carrier.Traceparent)
+}
+
+var (
+	tracer = newSpanTracer()
+
+	droppedSpans = metrics.counter("chat_trace_spans_dropped_total",
+		"Trace spans dropped because the export queue was full.", "instance")
+)
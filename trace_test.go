@@ -0,0 +1,216 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// memoryExporter keeps exported spans for tests.
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+func (e *memoryExporter) export(batch []*span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, batch...)
+	return nil
+}
+
+// collect hands the spans queued by the tracer to the exporter and returns
+// every span exported so far.
+func (e *memoryExporter) collect() []*span {
+	for {
+		select {
+		case s := <-tracer.spans:
+			e.export([]*span{s})
+		default:
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			return append([]*span(nil), e.spans...)
+		}
+	}
+}
+
+// useMemoryExporter enables tracing into a memoryExporter for the duration
+// of the test.
+func useMemoryExporter(t *testing.T) *memoryExporter {
+	e := &memoryExporter{}
+	saved := tracer.exporter
+	tracer.exporter = e
+	e.collect()
+	e.spans = nil
+	t.Cleanup(func() { tracer.exporter = saved })
+	return e
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "0af7651916cd43dd8448eb211c80319c"
+		spanID  = "b7ad6b7169203331"
+	)
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"00-" + traceID + "-" + spanID + "-01", true},
+		{"00-" + traceID + "-" + spanID + "-00", true},
+		{"", false},
+		{"garbage", false},
+		{"01-" + traceID + "-" + spanID + "-01", false},
+		{"00-" + traceID[:31] + "-" + spanID + "-01", false},
+		{"00-" + traceID + "-" + spanID[:15] + "-01", false},
+		{"00-" + traceID + "-" + spanID, false},
+		{"00-" + traceID + "-" + spanID + "-01-extra", false},
+		{"00-" + strings.Replace(traceID, "0", "x", 1) + "-" + spanID + "-01", false},
+		{"00-" + traceID + "-" + strings.Replace(spanID, "b", "g", 1) + "-01", false},
+		{"00-" + strings.Repeat("0", 32) + "-" + spanID + "-01", false},
+		{"00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false},
+	}
+	for _, tt := range tests {
+		sc := parseTraceparent(tt.value)
+		if sc.valid() != tt.valid {
+			t.Errorf("parseTraceparent(%q).valid() = %v, want %v", tt.value, sc.valid(), tt.valid)
+		}
+		if tt.valid && sc.traceparent()[:52] != tt.value[:52] {
+			t.Errorf("parseTraceparent(%q).traceparent() = %q", tt.value, sc.traceparent())
+		}
+	}
+}
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	useMemoryExporter(t)
+	sc := tracer.start("test", spanContext{}).context()
+
+	data := injectTraceContext([]byte(`{"handle":"ann","text":"hi"}`), sc)
+	if !strings.Contains(string(data), `"handle":"ann"`) || !strings.Contains(string(data), `"text":"hi"`) {
+		t.Errorf("inject lost fields: %s", data)
+	}
+	if got := extractTraceContext(data); got != sc {
+		t.Errorf("extract = %v, want %v", got, sc)
+	}
+	if _, err := validateMessage(data); err != nil {
+		t.Errorf("message with trace context is invalid: %v", err)
+	}
+
+	// A message that already carries a context gets the new one.
+	child := tracer.start("child", sc).context()
+	if got := extractTraceContext(injectTraceContext(data, child)); got != child {
+		t.Errorf("reinjected context = %v, want %v", got, child)
+	}
+
+	for _, in := range []string{`not json`, `["array"]`, `"string"`} {
+		if out := injectTraceContext([]byte(in), sc); string(out) != in {
+			t.Errorf("inject(%s) = %s, want it unchanged", in, out)
+		}
+		if got := extractTraceContext([]byte(in)); got.valid() {
+			t.Errorf("extract(%s) = %v", in, got)
+		}
+	}
+	if out := injectTraceContext([]byte(`{"a":1}`), spanContext{}); string(out) != `{"a":1}` {
+		t.Errorf("inject of an invalid context = %s", out)
+	}
+	if got := extractTraceContext([]byte(`{"traceparent":"bogus"}`)); got.valid() {
+		t.Errorf("extract of a bogus traceparent = %v", got)
+	}
+
+	tracer.exporter = nil
+	if got := extractTraceContext(data); got.valid() {
+		t.Error("extract with tracing disabled returned a context")
+	}
+	if s := tracer.start("disabled", sc); s != nil {
+		t.Error("start with tracing disabled returned a span")
+	}
+}
+
+// TestMessageTrace follows a message from a websocket client through the
+// writer, Redis and back to the client, and checks that its spans form a
+// single trace.
+func TestMessageTrace(t *testing.T) {
+	fake, _ := testHub(t)
+	exporter := useMemoryExporter(t)
+	useTenants(t)
+
+	ws := dialChat(t, "")
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"handle":"ann","text":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake Redis doesn't deliver to subscribers, so hand the published
+	// message to the receiver like the subscription would.
+	var published fakeMessage
+	waitFor(t, "the message to be published", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if len(fake.published) == 0 {
+			return false
+		}
+		published = fake.published[0]
+		return true
+	})
+	if published.channel != defaultTenant.channel() {
+		t.Errorf("published on %q", published.channel)
+	}
+	rr.receive(published.channel, []byte(published.data))
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, delivered, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(delivered), `"text":"hello"`) || !extractTraceContext(delivered).valid() {
+		t.Errorf("delivered %s", delivered)
+	}
+
+	want := []string{"chat.receive", "chat.validate", "chat.enqueue", "redis.publish", "redis.receive", "websocket.write"}
+	byName := make(map[string]*span)
+	waitFor(t, "the spans to be exported", func() bool {
+		for _, s := range exporter.collect() {
+			byName[s.name] = s
+		}
+		return len(byName) >= len(want)
+	})
+	root := byName["chat.receive"]
+	if root == nil || root.parent.valid() {
+		t.Fatalf("chat.receive is not a root span: %+v", root)
+	}
+	parents := map[string]string{
+		"chat.validate":   "chat.receive",
+		"chat.enqueue":    "chat.receive",
+		"redis.publish":   "chat.enqueue",
+		"redis.receive":   "chat.enqueue",
+		"websocket.write": "redis.receive",
+	}
+	for _, name := range want {
+		s := byName[name]
+		if s == nil {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if s.ctx.traceID != root.ctx.traceID {
+			t.Errorf("%s is in trace %x, want %x", name, s.ctx.traceID, root.ctx.traceID)
+		}
+		if p := parents[name]; p != "" && (byName[p] == nil || s.parent.spanID != byName[p].ctx.spanID) {
+			t.Errorf("%s's parent isn't %s", name, p)
+		}
+		if s.err != nil {
+			t.Errorf("%s failed: %v", name, s.err)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
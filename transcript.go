@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The transcript sink keeps a plain log of the messages of the rooms whose
+// settings ask for it, independently of Redis. Every message this instance
+// receives for such a room is appended as a JSON line to
+//
+//   DIR/ROOM/transcript.jsonl
+//
+// which is rotated once it reaches transcript_max_bytes or is older than
+// transcript_rotate_interval. A rotated file is compressed to
+// transcript-TIMESTAMP.jsonl.gz, next to a .sha256 file holding its checksum
+// in sha256sum format, and removed once older than transcript_retention.
+//
+// Lines are written whole and synced before the next batch is taken, so a
+// crash loses at most the batch being written. A partial last line left by a
+// crash is cut off when the file is reopened, and a rotation interrupted
+// before its compression finished is completed.
+//
+// Transcripts are lossy under load: messages arriving while the queue is full
+// are dropped. Once the queue has drained a line such as
+//
+//   {"time": "...", "instance": "...", "dropped": 12}
+//
+// is written in their place, with the time of the first dropped message, so
+// that the gap shows in the file.
+
+const (
+	transcriptName   = "transcript.jsonl"
+	transcriptPrefix = "transcript-"
+	transcriptStamp  = "20060102T150405.000Z"
+)
+
+// transcriptEntry is a line of a transcript. Dropped is set instead of
+// Message on the line marking dropped messages.
+type transcriptEntry struct {
+	Time     time.Time       `json:"time"`
+	Instance string          `json:"instance"`
+	Message  json.RawMessage `json:"message,omitempty"`
+	Dropped  int             `json:"dropped,omitempty"`
+
+	tenant *tenant
+}
+
+// transcriptSink writes the transcripts of this instance. It is nil when
+// transcripts are disabled.
+type transcriptSink struct {
+	dir     string
+	entries chan transcriptEntry
+	stop    chan struct{}
+	done    chan struct{}
+	files   map[string]*transcriptFile
+
+	mu      sync.Mutex
+	dropped map[string]*transcriptEntry // markers not written yet, by tenant ID
+}
+
+var transcripts *transcriptSink
+
+func newTranscriptSink(dir string) (*transcriptSink, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrap(err, "Unable to create transcript directory")
+	}
+	return &transcriptSink{
+		dir:     dir,
+		entries: make(chan transcriptEntry, cfg().TranscriptQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		files:   make(map[string]*transcriptFile),
+		dropped: make(map[string]*transcriptEntry),
+	}, nil
+}
+
+// write queues a message of t for its transcript. It is called from the
+// Redis receiver, so a message is dropped and counted rather than holding up
+// the broadcast when the disk can't keep up.
+func (s *transcriptSink) write(t *tenant, data []byte) {
+	select {
+	case s.entries <- transcriptEntry{Time: time.Now().UTC(), Instance: instance, Message: data, tenant: t}:
+	default:
+		log.WithField("tenant", t.name()).Error("Transcript queue full! Dropping message")
+		transcriptDrops.inc(instance)
+		s.mu.Lock()
+		if m, ok := s.dropped[t.ID]; ok {
+			m.Dropped++
+		} else {
+			s.dropped[t.ID] = &transcriptEntry{Time: time.Now().UTC(), Instance: instance, Dropped: 1, tenant: t}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// close writes the queued messages and closes the files. Messages written
+// afterwards are dropped once the queue is full, as the process is about to
+// exit.
+func (s *transcriptSink) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// run writes queued messages in batches, syncing the files after each batch,
+// and applies the rotation and retention rules.
+func (s *transcriptSink) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	defer close(s.done)
+	s.sweep()
+	for {
+		select {
+		case e := <-s.entries:
+			s.writeBatch(e)
+		case <-s.stop:
+			for len(s.entries) > 0 {
+				s.writeBatch(<-s.entries)
+			}
+			s.closeAll()
+			return
+		case <-ticker.C:
+			for _, f := range s.files {
+				if f.due(0) {
+					s.rotate(f)
+				}
+			}
+			s.sweep()
+		}
+	}
+}
+
+// writeBatch writes e and the messages queued behind it, then syncs the
+// files written to. Once the queue is empty it also marks the messages
+// dropped meanwhile.
+func (s *transcriptSink) writeBatch(e transcriptEntry) {
+	dirty := make(map[*transcriptFile]bool)
+	s.append(e, dirty)
+	for n := 1; n < 256 && len(s.entries) > 0; n++ {
+		s.append(<-s.entries, dirty)
+	}
+	if len(s.entries) == 0 {
+		s.mu.Lock()
+		dropped := s.dropped
+		s.dropped = make(map[string]*transcriptEntry)
+		s.mu.Unlock()
+		for _, m := range dropped {
+			s.append(*m, dirty)
+		}
+	}
+	for f := range dirty {
+		if err := f.sync(); err != nil {
+			log.WithFields(logrus.Fields{"file": f.path, "err": err}).Error("Unable to sync transcript")
+		}
+	}
+}
+
+func (s *transcriptSink) append(e transcriptEntry, dirty map[*transcriptFile]bool) {
+	l := log.WithField("tenant", e.tenant.name())
+	line, err := json.Marshal(e)
+	if err != nil {
+		l.WithField("err", err).Error("Unable to encode transcript entry")
+		return
+	}
+	line = append(line, '\n')
+	f, err := s.file(e.tenant)
+	if err != nil {
+		l.WithField("err", err).Error("Unable to open transcript")
+		return
+	}
+	if f.due(len(line)) {
+		if err := f.sync(); err != nil {
+			l.WithField("err", err).Error("Unable to sync transcript")
+		}
+		delete(dirty, f)
+		s.rotate(f)
+		if f, err = s.file(e.tenant); err != nil {
+			l.WithField("err", err).Error("Unable to open transcript")
+			return
+		}
+	}
+	if err := f.append(line); err != nil {
+		l.WithFields(logrus.Fields{"file": f.path, "err": err}).Error("Unable to write transcript")
+		return
+	}
+	dirty[f] = true
+}
+
+// file returns the open transcript of t, opening it if needed.
+func (s *transcriptSink) file(t *tenant) (*transcriptFile, error) {
+	if f, ok := s.files[t.ID]; ok {
+		return f, nil
+	}
+	dir := filepath.Join(s.dir, t.name())
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrap(err, "Unable to create transcript directory")
+	}
+	f, err := openTranscript(filepath.Join(dir, transcriptName))
+	if err != nil {
+		return nil, err
+	}
+	s.files[t.ID] = f
+	return f, nil
+}
+
+// rotate closes f, renames it aside and compresses it. The next message of
+// its room opens a new file.
+func (s *transcriptSink) rotate(f *transcriptFile) {
+	for id, open := range s.files {
+		if open == f {
+			delete(s.files, id)
+		}
+	}
+	l := log.WithField("file", f.path)
+	if err := f.close(); err != nil {
+		l.WithField("err", err).Error("Unable to close transcript")
+	}
+	if f.size == 0 {
+		return
+	}
+	rotated := filepath.Join(filepath.Dir(f.path), transcriptPrefix+time.Now().UTC().Format(transcriptStamp)+".jsonl")
+	if err := os.Rename(f.path, rotated); err != nil {
+		l.WithField("err", err).Error("Unable to rotate transcript")
+		return
+	}
+	if err := compressTranscript(rotated); err != nil {
+		l.WithField("err", err).Error("Unable to compress transcript")
+		return
+	}
+	l.WithField("rotated", rotated+".gz").Info("Rotated transcript")
+}
+
+func (s *transcriptSink) closeAll() {
+	for id, f := range s.files {
+		if err := f.close(); err != nil {
+			log.WithFields(logrus.Fields{"file": f.path, "err": err}).Error("Unable to close transcript")
+		}
+		delete(s.files, id)
+	}
+}
+
+// sweep completes interrupted rotations and applies the retention.
+func (s *transcriptSink) sweep() {
+	retention := cfg().TranscriptRetention
+	rooms, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.WithField("err", err).Error("Unable to list transcripts")
+		return
+	}
+	for _, room := range rooms {
+		if !room.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.dir, room.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.WithField("err", err).Error("Unable to list transcripts")
+			continue
+		}
+		for _, fi := range files {
+			name := fi.Name()
+			path := filepath.Join(dir, name)
+			if !strings.HasPrefix(name, transcriptPrefix) {
+				continue
+			}
+			l := log.WithField("file", path)
+			switch {
+			case strings.HasSuffix(name, ".tmp"):
+				os.Remove(path)
+			case strings.HasSuffix(name, ".jsonl"):
+				if err := compressTranscript(path); err != nil {
+					l.WithField("err", err).Error("Unable to compress transcript")
+				}
+			case strings.HasSuffix(name, ".jsonl.gz") && time.Since(fi.ModTime()) > retention:
+				if err := os.Remove(path); err != nil {
+					l.WithField("err", err).Error("Unable to remove expired transcript")
+					continue
+				}
+				os.Remove(path + ".sha256")
+				l.Info("Removed expired transcript")
+			}
+		}
+	}
+}
+
+// transcriptFile is the transcript being appended to.
+type transcriptFile struct {
+	path   string
+	file   *os.File
+	size   int
+	opened time.Time
+}
+
+// openTranscript opens path for appending, cutting off a partial last line
+// left by a crash.
+func openTranscript(path string) (*transcriptFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open transcript")
+	}
+	size, err := completeLines(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "Unable to open transcript")
+	}
+	opened := time.Now()
+	if fi, err := file.Stat(); err == nil && size > 0 {
+		// Rotate by age from when the file was started, which is about
+		// when it was last rotated or first written.
+		opened = fi.ModTime()
+		if created, ok := firstEntryTime(path); ok {
+			opened = created
+		}
+	}
+	return &transcriptFile{path: path, file: file, size: int(size), opened: opened}, nil
+}
+
+// completeLines truncates file after its last newline and returns its size.
+func completeLines(file *os.File) (int64, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "Unable to read transcript")
+	}
+	size := fi.Size()
+	if size == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		n := int64(len(buf))
+		if end < n {
+			n = end
+		}
+		if _, err := file.ReadAt(buf[:n], end-n); err != nil {
+			return 0, errors.Wrap(err, "Unable to read transcript")
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end != size {
+		log.WithFields(logrus.Fields{"file": file.Name(), "bytes": size - end}).Warning("Cutting off partial transcript line")
+		if err := file.Truncate(end); err != nil {
+			return 0, errors.Wrap(err, "Unable to repair transcript")
+		}
+	}
+	return end, nil
+}
+
+// firstEntryTime returns the time of the first entry of the transcript at
+// path.
+func firstEntryTime(path string) (time.Time, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return time.Time{}, false
+	}
+	var e transcriptEntry
+	if json.Unmarshal(line, &e) != nil || e.Time.IsZero() {
+		return time.Time{}, false
+	}
+	return e.Time, true
+}
+
+// due returns true if the file has to be rotated before n more bytes are
+// written to it.
+func (f *transcriptFile) due(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	return f.size+n > cfg().TranscriptMaxBytes || time.Since(f.opened) > cfg().TranscriptRotateInterval
+}
+
+// append writes line with a single write so that it isn't interleaved.
+func (f *transcriptFile) append(line []byte) error {
+	if f.size == 0 {
+		f.opened = time.Now()
+	}
+	n, err := f.file.Write(line)
+	f.size += n
+	return err
+}
+
+func (f *transcriptFile) sync() error {
+	return f.file.Sync()
+}
+
+func (f *transcriptFile) close() error {
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// compressTranscript compresses the rotated transcript at path to path.gz,
+// writes its checksum to path.gz.sha256 and removes path. Each file is
+// written under a temporary name and renamed once synced, so that a crash
+// leaves either the uncompressed transcript or both complete files.
+func compressTranscript(path string) error {
+	gz := path + ".gz"
+	in, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "Unable to open rotated transcript")
+	}
+	defer in.Close()
+
+	sum := sha256.New()
+	err = writeFileAtomic(gz, func(w io.Writer) error {
+		zw := gzip.NewWriter(io.MultiWriter(w, sum))
+		zw.Name = filepath.Base(path)
+		if _, err := io.Copy(zw, in); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		return errors.Wrap(err, "Unable to compress transcript")
+	}
+	err = writeFileAtomic(gz+".sha256", func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s  %s\n", hex.EncodeToString(sum.Sum(nil)), filepath.Base(gz))
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "Unable to write transcript checksum")
+	}
+	if err := os.Remove(path); err != nil {
+		return errors.Wrap(err, "Unable to remove rotated transcript")
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeFileAtomic writes path through write, under a temporary name that is
+// renamed to path once the file has been synced.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// syncDir makes renames in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
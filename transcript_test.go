@@ -0,0 +1,232 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompleteLines(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"", ""},
+		{"a\nb\n", "a\nb\n"},
+		{"a\nb\npart", "a\nb\n"},
+		{"part", ""},
+		// The partial line spans more than one read.
+		{"a\n" + long, "a\n"},
+		{long + "\n" + long, long + "\n"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), transcriptName)
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := completeLines(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(tt.want)) || string(got) != tt.want {
+			t.Errorf("completeLines(%.10q…) left %d bytes %.10q…, want %d bytes %.10q…", tt.content, size, got, len(tt.want), tt.want)
+		}
+	}
+}
+
+func TestCompressTranscript(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, transcriptPrefix+"20240501T120000.000Z.jsonl")
+	content := "{\"message\":1}\n{\"message\":2}\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressTranscript(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("rotated transcript still exists: %v", err)
+	}
+
+	gz, err := ioutil.ReadFile(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(gz)
+	want := hex.EncodeToString(sum[:]) + "  " + filepath.Base(path) + ".gz\n"
+	if got, err := ioutil.ReadFile(path + ".gz.sha256"); err != nil || string(got) != want {
+		t.Errorf("checksum file = %q, %v; want %q", got, err, want)
+	}
+
+	f, err := os.Open(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(zr); err != nil || string(got) != content {
+		t.Errorf("compressed transcript = %q, %v; want %q", got, err, content)
+	}
+}
+
+// rotatedTranscripts returns the names of the compressed transcripts in dir.
+func rotatedTranscripts(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, transcriptPrefix+"*.jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestTranscriptRotation(t *testing.T) {
+	useTenants(t)
+	useConfig(t, func(c *config) {
+		c.TranscriptMaxBytes = 200
+		c.TranscriptRotateInterval = time.Hour
+	})
+	message := []byte(`{"handle":"ann","text":"` + strings.Repeat("x", 50) + `"}`)
+
+	t.Run("size", func(t *testing.T) {
+		s, err := newTranscriptSink(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.closeAll()
+		dir := filepath.Join(s.dir, defaultTenantName)
+		dirty := make(map[*transcriptFile]bool)
+		s.append(transcriptEntry{Time: time.Now(), Message: message, tenant: defaultTenant}, dirty)
+		if got := rotatedTranscripts(t, dir); len(got) != 0 {
+			t.Fatalf("rotated after one message: %v", got)
+		}
+		s.append(transcriptEntry{Time: time.Now(), Message: message, tenant: defaultTenant}, dirty)
+		if got := rotatedTranscripts(t, dir); len(got) != 1 {
+			t.Fatalf("rotated %v after reaching the size limit, want one file", got)
+		}
+		if f := s.files[""]; f == nil || f.size == 0 || f.size > cfg().TranscriptMaxBytes {
+			t.Errorf("new transcript = %+v, want the second message only", f)
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		s, err := newTranscriptSink(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.closeAll()
+		dir := filepath.Join(s.dir, defaultTenantName)
+		dirty := make(map[*transcriptFile]bool)
+		short := []byte(`{"text":"hi"}`)
+		s.append(transcriptEntry{Time: time.Now(), Message: short, tenant: defaultTenant}, dirty)
+		s.files[""].opened = time.Now().Add(-2 * time.Hour)
+		s.append(transcriptEntry{Time: time.Now(), Message: short, tenant: defaultTenant}, dirty)
+		if got := rotatedTranscripts(t, dir); len(got) != 1 {
+			t.Fatalf("rotated %v after the rotate interval, want one file", got)
+		}
+	})
+}
+
+func TestTranscriptSweep(t *testing.T) {
+	useConfig(t, func(c *config) { c.TranscriptRetention = time.Hour })
+	s, err := newTranscriptSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(s.dir, "acme")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// A rotation interrupted after the rename, with a partial compression.
+	rotated := write(transcriptPrefix+"20240501T120000.000Z.jsonl", "{\"message\":1}\n")
+	partial := write(transcriptPrefix+"20240501T120000.000Z.jsonl.gz.tmp", "partial")
+	// An expired rotated transcript.
+	expired := write(transcriptPrefix+"20240401T120000.000Z.jsonl.gz", "old")
+	write(transcriptPrefix+"20240401T120000.000Z.jsonl.gz.sha256", "old")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(expired, old, old); err != nil {
+		t.Fatal(err)
+	}
+	current := write(transcriptName, "{\"message\":2}\n")
+
+	s.sweep()
+
+	for _, path := range []string{rotated, partial, expired, expired + ".sha256"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", filepath.Base(path), err)
+		}
+	}
+	for _, path := range []string{rotated + ".gz", rotated + ".gz.sha256", current} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s is missing: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestTranscriptQueueFull(t *testing.T) {
+	useConfig(t, func(c *config) { c.TranscriptQueueSize = 1 })
+	s, err := newTranscriptSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := metricValue(transcriptDrops, instance)
+	done := make(chan struct{})
+	go func() {
+		s.write(defaultTenant, []byte(`{"text":"first"}`))
+		s.write(defaultTenant, []byte(`{"text":"second"}`))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked on a full queue")
+	}
+	if got := metricValue(transcriptDrops, instance) - before; got != 1 {
+		t.Errorf("dropped %v messages, want 1", got)
+	}
+	if len(s.entries) != 1 {
+		t.Errorf("queued %d messages, want 1", len(s.entries))
+	}
+
+	// The gap is marked once the queue has drained.
+	s.write(defaultTenant, []byte(`{"text":"third"}`))
+	s.writeBatch(<-s.entries)
+	s.closeAll()
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, defaultTenantName, transcriptName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("transcript = %q, want the first message and a marker", data)
+	}
+	var marker transcriptEntry
+	if err := json.Unmarshal([]byte(lines[1]), &marker); err != nil || marker.Dropped != 2 || marker.Message != nil || marker.Time.IsZero() {
+		t.Errorf("marker = %q, want 2 dropped messages", lines[1])
+	}
+}
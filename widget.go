@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// sitesKey is the Redis hash holding the sites allowed to embed the widget,
+// keyed by site key. Site keys are looked up before the tenant is known, so
+// the hash isn't in a tenant's namespace.
+var sitesKey = redisKey("sites")
+
+var validColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// site is a website allowed to embed the chat widget, which is served from
+// /widget.js. The widget joins the chat of the site's tenant as a guest.
+type site struct {
+	Key    string `json:"key"`
+	Tenant string `json:"tenant,omitempty"`
+
+	// Origins the widget may be embedded on, such as https://example.com.
+	Origins []string `json:"origins"`
+
+	// Appearance and behaviour of the widget.
+	Title     string `json:"title,omitempty"`
+	Greeting  string `json:"greeting,omitempty"`
+	Color     string `json:"color,omitempty"`
+	Position  string `json:"position,omitempty"`
+	StartOpen bool   `json:"start_open,omitempty"`
+}
+
+// widgetConfig is the part of a site returned to the widget.
+type widgetConfig struct {
+	Title     string `json:"title"`
+	Greeting  string `json:"greeting,omitempty"`
+	Color     string `json:"color"`
+	Position  string `json:"position"`
+	StartOpen bool   `json:"start_open"`
+}
+
+func (s *site) validate() error {
+	if len(s.Origins) == 0 {
+		return errors.New("a site needs at least one origin")
+	}
+	for i, o := range s.Origins {
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return errors.Errorf("origin %q must be a scheme and host, such as https://example.com", o)
+		}
+		s.Origins[i] = strings.ToLower(u.Scheme + "://" + u.Host)
+	}
+	if s.Color != "" && !validColor.MatchString(s.Color) {
+		return errors.Errorf("color %q must be like #0066cc", s.Color)
+	}
+	if s.Position != "" && s.Position != "left" && s.Position != "right" {
+		return errors.Errorf("position %q must be left or right", s.Position)
+	}
+	return nil
+}
+
+// allows returns true if the widget may be embedded on origin.
+func (s *site) allows(origin string) bool {
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	for _, o := range s.Origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *site) config() widgetConfig {
+	c := widgetConfig{
+		Title:     s.Title,
+		Greeting:  s.Greeting,
+		Color:     s.Color,
+		Position:  s.Position,
+		StartOpen: s.StartOpen,
+	}
+	if c.Title == "" {
+		c.Title = "Chat"
+	}
+	if c.Color == "" {
+		c.Color = "#337ab7"
+	}
+	if c.Position == "" {
+		c.Position = "right"
+	}
+	return c
+}
+
+// getSite returns the site with the provided key, or nil if there is none.
+func getSite(pool *redis.Pool, key string) (*site, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("HGET", sitesKey, key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read site")
+	}
+	var s site
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.Wrapf(err, "Unmarshaling site %s", key)
+	}
+	return &s, nil
+}
+
+// listSites returns the sites of ts.
+func listSites(pool *redis.Pool, ts []*tenant) ([]*site, error) {
+	wanted := make(map[string]bool, len(ts))
+	for _, t := range ts {
+		wanted[t.ID] = true
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", sitesKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list sites")
+	}
+	list := make([]*site, 0, len(values))
+	for key, data := range values {
+		var s site
+		if err := json.Unmarshal([]byte(data), &s); err != nil {
+			return nil, errors.Wrapf(err, "Unmarshaling site %s", key)
+		}
+		if wanted[s.Tenant] {
+			list = append(list, &s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// saveSite creates or updates a site, generating its key if it is new.
+func saveSite(pool *redis.Pool, s *site) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if s.Key == "" {
+		s.Key = newID()
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "Marshaling site")
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", sitesKey, s.Key, data); err != nil {
+		return errors.Wrap(err, "Unable to save site")
+	}
+	return nil
+}
+
+// removeSite removes a site. Guest tokens issued for it stop working.
+func removeSite(pool *redis.Pool, key string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HDEL", sitesKey, key); err != nil {
+		return errors.Wrap(err, "Unable to remove site")
+	}
+	return nil
+}
+
+// guestClaims identify a widget guest. They are signed with the widget
+// secret so that any instance can verify them.
+type guestClaims struct {
+	Site    string `json:"site"`
+	Tenant  string `json:"tenant,omitempty"`
+	Handle  string `json:"handle"`
+	Expires int64  `json:"exp"`
+}
+
+func signGuestToken(claims guestClaims) (string, error) {
+	return signClaims(cfg().WidgetSecret, claims)
+}
+
+func verifyGuestToken(token string) (guestClaims, error) {
+	var claims guestClaims
+	if err := verifyClaims(cfg().WidgetSecret, token, &claims); err != nil {
+		return claims, errors.Wrap(err, "Guest token")
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, errors.New("guest token has expired")
+	}
+	return claims, nil
+}
+
+// signClaims encodes claims and signs them with key, so that any instance
+// holding the key can verify them.
+func signClaims(key string, claims interface{}) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "Marshaling claims")
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + claimsSignature(key, payload), nil
+}
+
+// verifyClaims checks that token was made by signClaims with key and decodes
+// its claims.
+func verifyClaims(key, token string, claims interface{}) error {
+	i := strings.LastIndex(token, ".")
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(claimsSignature(key, token[:i]))) {
+		return errors.New("invalid signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return errors.Wrap(err, "Decoding claims")
+	}
+	return errors.Wrap(json.Unmarshal(data, claims), "Unmarshaling claims")
+}
+
+func claimsSignature(key, payload string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// widgetGuest authenticates a websocket request made by the widget with the
+// provided guest token, returning the guest's tenant and claims. The request
+// must come from one of the site's origins and the site must still exist.
+func widgetGuest(pool *redis.Pool, r *http.Request, token string) (*tenant, guestClaims, error) {
+	t, claims, s, err := guestTenant(pool, token)
+	if err != nil {
+		return nil, claims, err
+	}
+	if !s.allows(r.Header.Get("Origin")) {
+		return nil, claims, errors.Errorf("origin %q is not allowed", r.Header.Get("Origin"))
+	}
+	return t, claims, nil
+}
+
+// guestTenant verifies the provided guest token and returns the guest's
+// tenant, claims and site, which must still exist.
+func guestTenant(pool *redis.Pool, token string) (*tenant, guestClaims, *site, error) {
+	if cfg().WidgetSecret == "" {
+		return nil, guestClaims{}, nil, errors.New("widgets are disabled")
+	}
+	claims, err := verifyGuestToken(token)
+	if err != nil {
+		return nil, claims, nil, err
+	}
+	s, err := getSite(pool, claims.Site)
+	if err != nil {
+		return nil, claims, nil, err
+	}
+	if s == nil || s.Tenant != claims.Tenant {
+		return nil, claims, nil, errors.New("site no longer exists")
+	}
+	t := tenants.get(s.Tenant)
+	if t == nil {
+		return nil, claims, nil, errors.New("tenant no longer exists")
+	}
+	return t, claims, s, nil
+}
+
+// readerTenant returns the tenant of a request for read-only content of the
+// room, snippets and custom emoji: the tenant selected like for the
+// websocket, the tenant of the widget guest whose token is in the
+// widget_token query parameter, or the tenant of the invite in the invite
+// query parameter. The token is enough as the content is read-only, so links
+// and images opened from the widget, which carry no Origin, work too. The
+// content of a private room is only served with an invite its address has
+// joined with. It writes an error and returns nil if there is no tenant.
+func readerTenant(w http.ResponseWriter, r *http.Request) *tenant {
+	q := r.URL.Query()
+	var t *tenant
+	var member bool
+	if token := q.Get("widget_token"); token != "" {
+		var guestSite *site
+		var err error
+		if t, _, guestSite, err = guestTenant(rr.pool, token); err != nil {
+			log.WithFields(logrus.Fields{"path": r.URL.Path, "err": err}).Warning("Rejected request of a widget guest")
+			http.Error(w, "Invalid widget token", http.StatusForbidden)
+			return nil
+		}
+		if origin := r.Header.Get("Origin"); guestSite.allows(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Vary", "Origin")
+	} else if token := q.Get("invite"); token != "" {
+		var err error
+		if t, err = inviteMember(rr.pool, token, remoteAddr(r)); err != nil {
+			log.WithFields(logrus.Fields{"path": r.URL.Path, "err": err}).Warning("Rejected request with an invite")
+			http.Error(w, "Invalid invite", http.StatusForbidden)
+			return nil
+		}
+		member = true
+	} else {
+		var ok bool
+		if t, ok = tenants.resolve(r); !ok {
+			http.Error(w, "Unknown tenant", http.StatusForbidden)
+			return nil
+		}
+	}
+	if rooms.get(t).Private && !member {
+		http.Error(w, "Private room", http.StatusForbidden)
+		return nil
+	}
+	return t
+}
+
+// readerQuery returns the query parameter, tenant_token, widget_token or
+// invite, that selected the tenant of r, for URLs to content of the same
+// tenant.
+func readerQuery(r *http.Request) url.Values {
+	q := r.URL.Query()
+	for _, name := range []string{"widget_token", "invite", "tenant_token"} {
+		if v := q.Get(name); v != "" {
+			return url.Values{name: {v}}
+		}
+	}
+	return nil
+}
+
+// widgetHandler serves the endpoints used by the widget, which are called
+// cross-origin from the sites embedding it.
+type widgetHandler struct {
+	pool *redis.Pool
+}
+
+// site returns the site named by the key query parameter after checking that
+// the request comes from one of its origins, and allows the origin to read
+// the response. It writes an error and returns nil otherwise.
+func (h *widgetHandler) site(w http.ResponseWriter, r *http.Request) *site {
+	w.Header().Set("Vary", "Origin")
+	if cfg().WidgetSecret == "" {
+		http.NotFound(w, r)
+		return nil
+	}
+	s, err := getSite(h.pool, r.URL.Query().Get("key"))
+	if err != nil {
+		log.WithField("err", err).Error("Unable to read site")
+		http.Error(w, "Unable to read site", http.StatusBadGateway)
+		return nil
+	}
+	if s == nil {
+		http.Error(w, "Unknown site", http.StatusNotFound)
+		return nil
+	}
+	origin := r.Header.Get("Origin")
+	if !s.allows(origin) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	return s
+}
+
+// handleConfig returns the appearance and behaviour of the widget.
+func (h *widgetHandler) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := h.site(w, r)
+	if s == nil {
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=60")
+	writeJSON(w, http.StatusOK, s.config())
+}
+
+// handleToken issues a guest identity to a visitor of a site.
+func (h *widgetHandler) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := h.site(w, r)
+	if s == nil {
+		return
+	}
+	t := tenants.get(s.Tenant)
+	if t == nil {
+		http.Error(w, "Unknown site", http.StatusNotFound)
+		return
+	}
+	addr := remoteAddr(r)
+	ok, err := allowGuestToken(h.pool, t, s.Key, addr)
+	if err != nil {
+		log.WithField("err", err).Error("Unable to count guest token")
+		http.Error(w, "Unable to issue guest token", http.StatusBadGateway)
+		return
+	}
+	if !ok {
+		log.WithFields(logrus.Fields{"site": s.Key, "remote_addr": addr}).Warning("Guest token limit reached")
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "Too many guest tokens", http.StatusTooManyRequests)
+		return
+	}
+	expires := time.Now().Add(cfg().WidgetTokenTTL)
+	claims := guestClaims{
+		Site:    s.Key,
+		Tenant:  s.Tenant,
+		Handle:  "guest-" + newID()[:6],
+		Expires: expires.Unix(),
+	}
+	token, err := signGuestToken(claims)
+	if err != nil {
+		http.Error(w, "Unable to issue guest token", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"handle":     claims.Handle,
+		"expires_at": expires.UTC(),
+	})
+}